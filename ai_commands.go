@@ -25,8 +25,39 @@ func RegisterAICommands(router *cmdroute.Router, dbMgr *DatabaseManager, mlSvc *
 	}
 
 	router.AddFunc("provider", handler.providerCommand)
-	router.AddFunc("model", handler.modelCommand)
 	router.AddFunc("aiconfig", handler.aiConfigCommand)
+	router.AddFunc("usage", handler.usageCommand)
+	router.AddFunc("aiparams", handler.aiParamsCommand)
+	router.Sub("chat", func(r *cmdroute.Router) {
+		r.AddFunc("new", handler.chatNewCommand)
+		r.AddFunc("list", handler.chatListCommand)
+		r.AddFunc("switch", handler.chatSwitchCommand)
+		r.AddFunc("delete", handler.chatDeleteCommand)
+	})
+	router.AddFunc("branches", handler.branchesCommand)
+	router.AddFunc("search", handler.searchCommand)
+	router.Sub("persona", func(r *cmdroute.Router) {
+		r.AddFunc("create", handler.personaCreateCommand)
+		r.AddFunc("edit", handler.personaEditCommand)
+		r.AddFunc("list", handler.personaListCommand)
+		r.AddFunc("use", handler.personaUseCommand)
+		r.AddFunc("reset", handler.personaResetCommand)
+	})
+	router.Sub("retention", func(r *cmdroute.Router) {
+		r.AddFunc("view", handler.retentionViewCommand)
+		r.AddFunc("set", handler.retentionSetCommand)
+		r.AddFunc("reset", handler.retentionResetCommand)
+	})
+
+	// Model discovery, exports and imports can take longer than Discord's 3
+	// second deadline
+	router.Group(func(r *cmdroute.Router) {
+		r.Use(cmdroute.Deferrable(botState, cmdroute.DeferOpts{Flags: discord.EphemeralMessage}))
+		r.AddFunc("model", handler.modelCommand)
+		r.AddFunc("failover", handler.failoverCommand)
+		r.AddFunc("export", handler.exportCommand)
+		r.AddFunc("import", handler.importCommand)
+	})
 }
 
 // providerCommand allows user to view and select a provider
@@ -68,21 +99,77 @@ func (h *aiCommandHandler) modelCommand(ctx context.Context, data cmdroute.Comma
 		return h.errorResponse("First select a provider using `/provider name:<provider>`")
 	}
 
-	// Get model name from arguments (if provided)
-	var selectedModel string
-	if len(data.Options) > 0 && data.Options[0].Name == "name" {
-		selectedModel = data.Options[0].String()
+	// Get model name, list filter and refresh flag from arguments (if provided)
+	selectedModel := data.Options.Find("name").String()
+	search := strings.ToLower(data.Options.Find("search").String())
+	refresh, _ := data.Options.Find("refresh").BoolValue()
+
+	if refresh {
+		h.mlService.RefreshModels(providerName)
 	}
 
 	// If no name provided - show list of models for current provider
 	if selectedModel == "" {
-		return h.listModelsResponse(providerName)
+		return h.listModelsResponse(providerName, search)
 	}
 
 	// Try to set the selected model
 	return h.setModelResponse(userID.String(), providerName, selectedModel)
 }
 
+// failoverCommand shows or sets the providers tried when the user's provider fails
+func (h *aiCommandHandler) failoverCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	chainOption := data.Options.Find("chain").String()
+	reset, _ := data.Options.Find("reset").BoolValue()
+
+	switch {
+	case reset:
+		if err := userDB.SetFailoverChain(userID, ""); err != nil {
+			return h.errorResponse(fmt.Sprintf("Cannot save preference: %v", err))
+		}
+	case chainOption != "":
+		chain := parseFailoverChain(chainOption)
+		// Check every step now rather than skipping it silently when needed
+		for _, target := range chain {
+			if _, err := h.mlService.ResolveModel(target.Provider, target.Model); err != nil {
+				return h.errorResponse(fmt.Sprintf("%v. Available providers: %s", err, strings.Join(h.mlService.GetAvailableProviders(), ", ")))
+			}
+		}
+		if err := userDB.SetFailoverChain(userID, formatFailoverChain(chain)); err != nil {
+			return h.errorResponse(fmt.Sprintf("Cannot save preference: %v", err))
+		}
+	}
+
+	chain, err := userDB.GetFailoverChain(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get preferences: %v", err))
+	}
+
+	response := "**Your failover chain:**\n"
+	switch {
+	case chain != "":
+		response += fmt.Sprintf("`%s`\n", chain)
+	case len(h.mlService.DefaultFailoverChain()) > 0:
+		response += fmt.Sprintf("Not set (using the server default: `%s`)\n", formatFailoverChain(h.mlService.DefaultFailoverChain()))
+	default:
+		response += "Not set\n"
+	}
+	response += "\nWhen your provider is rate limited, down or times out, these are tried in order.\n"
+	response += "Usage: `/failover chain:openrouter,mistral:mistral-small-latest,gemini` (`reset:` goes back to the server default)"
+
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(response),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
 // aiConfigCommand shows user's current AI configuration
 func (h *aiCommandHandler) aiConfigCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
 	userID := data.Event.SenderID()
@@ -107,7 +194,11 @@ func (h *aiCommandHandler) aiConfigCommand(ctx context.Context, data cmdroute.Co
 	}
 
 	if modelName == "none" || modelName == "" {
-		response += "Model: Not selected\n"
+		if provider := h.mlService.GetProvider(providerName); provider != nil {
+			response += fmt.Sprintf("Model: Not selected (using default: %s)\n", provider.GetDefaultModel())
+		} else {
+			response += "Model: Not selected\n"
+		}
 	} else {
 		response += fmt.Sprintf("Model: %s\n", modelName)
 	}
@@ -115,6 +206,9 @@ func (h *aiCommandHandler) aiConfigCommand(ctx context.Context, data cmdroute.Co
 	response += "\n**Available commands:**\n"
 	response += "• `/provider` - View and set your AI provider\n"
 	response += "• `/model` - View and set your AI model\n"
+	response += "• `/failover` - View and set your fallback providers\n"
+	response += "• `/aiparams` - View and set temperature, max tokens and other generation parameters\n"
+	response += "• `/usage` - View your token usage and cost\n"
 
 	return &api.InteractionResponseData{
 		Content: option.NewNullableString(response),
@@ -167,16 +261,12 @@ func (h *aiCommandHandler) setProviderResponse(userID, providerName string) *api
 		return h.errorResponse(fmt.Sprintf("Cannot save preference: %v", err))
 	}
 
-	// Show available models for this provider
-	models := provider.GetAvailableModels()
-	modelsStr := strings.Join(models, ", ")
-
 	response := fmt.Sprintf(
 		"Selected provider: **%s**\n\n"+
-			"**Available models:**\n%s\n\n"+
-			"Next, use `/model name:<model>` to choose a model.",
+			"Default model: **%s**\n"+
+			"Use `/model` to browse the available models and `/model name:<model>` to choose a different one.",
 		providerName,
-		modelsStr,
+		provider.GetDefaultModel(),
 	)
 
 	return &api.InteractionResponseData{
@@ -185,19 +275,42 @@ func (h *aiCommandHandler) setProviderResponse(userID, providerName string) *api
 	}
 }
 
-// listModelsResponse returns a list of models for the current provider
-func (h *aiCommandHandler) listModelsResponse(providerName string) *api.InteractionResponseData {
+// listModelsResponse returns a list of models for the current provider,
+// optionally filtered by a search term
+func (h *aiCommandHandler) listModelsResponse(providerName, search string) *api.InteractionResponseData {
 	provider := h.mlService.GetProvider(providerName)
 	if provider == nil {
 		return h.errorResponse(fmt.Sprintf("Provider '%s' not found", providerName))
 	}
 
-	models := provider.GetAvailableModels()
+	var models []ModelInfo
+	for _, m := range h.mlService.GetModels(providerName) {
+		if search == "" || strings.Contains(strings.ToLower(m.ID), search) {
+			models = append(models, m)
+		}
+	}
+
+	if len(models) == 0 {
+		return h.errorResponse(fmt.Sprintf("No models of %s match '%s'", providerName, search))
+	}
+
 	response := fmt.Sprintf("**Available models for %s:**\n", providerName)
-	for _, m := range models {
-		response += fmt.Sprintf("• %s\n", m)
+	footer := "\nUsage: `/model name:<model>` (`search:` filters the list, `refresh:` reloads it)"
+	for i, m := range models {
+		line := "• " + formatModelInfo(m)
+		if m.ID == provider.GetDefaultModel() {
+			line += " (default)"
+		}
+		line += "\n"
+
+		// Keep the list inside a single Discord message
+		if len(response)+len(line)+len(footer)+40 > MaxMessageLength {
+			response += fmt.Sprintf("…and %d more. Use `search:` to narrow the list.\n", len(models)-i)
+			break
+		}
+		response += line
 	}
-	response += "\nUsage: `/model name:<model>`"
+	response += footer
 
 	return &api.InteractionResponseData{
 		Content: option.NewNullableString(response),
@@ -207,6 +320,16 @@ func (h *aiCommandHandler) listModelsResponse(providerName string) *api.Interact
 
 // setModelResponse sets a model for the user
 func (h *aiCommandHandler) setModelResponse(userID, providerName, modelName string) *api.InteractionResponseData {
+	provider := h.mlService.GetProvider(providerName)
+	if provider == nil {
+		return h.errorResponse(fmt.Sprintf("Provider '%s' not found", providerName))
+	}
+
+	// Only accept models the provider actually offers
+	if _, err := h.mlService.ResolveModel(providerName, modelName); err != nil {
+		return h.errorResponse(fmt.Sprintf("%v. Use `/model` to see available models", err))
+	}
+
 	userDB, err := h.dbManager.GetUserDB(userID)
 	if err != nil {
 		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
@@ -224,6 +347,34 @@ func (h *aiCommandHandler) setModelResponse(userID, providerName, modelName stri
 	}
 }
 
+// formatModelInfo describes a model with the metadata discovered for it
+func formatModelInfo(m ModelInfo) string {
+	var details []string
+	if m.ContextLength > 0 {
+		details = append(details, formatTokenCount(m.ContextLength)+" context")
+	}
+	if m.PromptPrice > 0 || m.CompletionPrice > 0 {
+		details = append(details, fmt.Sprintf("$%.2f in / $%.2f out per 1M tokens", m.PromptPrice, m.CompletionPrice))
+	}
+
+	if len(details) == 0 {
+		return m.ID
+	}
+	return fmt.Sprintf("%s — %s", m.ID, strings.Join(details, ", "))
+}
+
+// formatTokenCount shortens token counts, e.g. 128000 becomes "128k"
+func formatTokenCount(tokens int) string {
+	switch {
+	case tokens >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(tokens)/1_000_000)
+	case tokens >= 1_000:
+		return fmt.Sprintf("%dk", tokens/1_000)
+	default:
+		return fmt.Sprintf("%d", tokens)
+	}
+}
+
 // errorResponse returns a standard error message
 func (h *aiCommandHandler) errorResponse(message string) *api.InteractionResponseData {
 	return &api.InteractionResponseData{
@@ -1,9 +1,157 @@
 package main
 
-import "context"
+import (
+	"context"
+	"encoding/base64"
+)
+
+// Conversation roles used in a ChatRequest
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	// RoleTool messages carry the result of a tool call
+	RoleTool = "tool"
+)
+
+// ChatMessage is a single turn of a conversation
+type ChatMessage struct {
+	Role    string
+	Content string
+	// Images are sent along with a user turn to providers with vision
+	Images []ImagePart
+	// ToolCalls are the tools an assistant turn asked to run
+	ToolCalls []ToolCall
+	// ToolCallID and ToolName identify the call a RoleTool message answers
+	ToolCallID string
+	ToolName   string
+}
+
+// ImagePart is an image attached to a user turn
+type ImagePart struct {
+	Name     string
+	MIMEType string
+	Data     []byte
+}
+
+// dataURL encodes the image as a base64 data: URL
+func (i ImagePart) dataURL() string {
+	return "data:" + i.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// ToolDefinition describes a tool the model may call
+type ToolDefinition struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments object
+	Parameters map[string]any
+}
+
+// ToolCall is a model's request to run a tool
+type ToolCall struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Arguments is a JSON object
+	Arguments string `json:"arguments"`
+	// Signature is opaque provider data that must be sent back with the
+	// call, such as Gemini's thought signatures
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// ChatRequest is a typed conversation: a system instruction followed by
+// alternating user/assistant turns. Providers map it to their native format.
+type ChatRequest struct {
+	Model    string
+	System   string
+	Messages []ChatMessage
+	Params   GenerationParams
+	// Tools the model may call; only sent to providers that support them
+	Tools []ToolDefinition
+}
+
+// Reasoning effort levels, from least to most thinking
+const (
+	ReasoningMinimal = "minimal"
+	ReasoningLow     = "low"
+	ReasoningMedium  = "medium"
+	ReasoningHigh    = "high"
+)
+
+// GenerationParams are optional sampling settings. Unset fields keep the
+// provider's defaults, and providers drop the ones a model doesn't support.
+type GenerationParams struct {
+	Temperature *float64
+	TopP        *float64
+	// MaxTokens limits the length of the response; 0 keeps the default
+	MaxTokens int
+	Seed      *int64
+	Stop      []string
+	// ReasoningEffort is one of the Reasoning* levels, or empty for the default
+	ReasoningEffort string
+}
+
+// modelOr returns the requested model, or def when none was set
+func (r ChatRequest) modelOr(def string) string {
+	if r.Model == "" {
+		return def
+	}
+	return r.Model
+}
+
+// Usage is the token accounting a provider reported for one response
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	// Cost is in US dollars; zero unless the provider reports it
+	Cost float64
+}
+
+// ChatResponse is a provider's answer to a ChatRequest
+type ChatResponse struct {
+	Content string
+	// ToolCalls are set when the model wants tools run before it answers
+	ToolCalls []ToolCall
+	Usage     Usage
+}
 
 type AIProvider interface {
-	GetResponse(ctx context.Context, prompt string) (string, error)
+	GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error)
 	GetName() string
+	GetDefaultModel() string
 	GetAvailableModels() []string
 }
+
+// StreamingProvider is implemented by providers that can stream a response
+// as it is generated. onDelta receives each text fragment in order and the
+// full response is returned once the stream completes.
+type StreamingProvider interface {
+	AIProvider
+	StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error)
+}
+
+// ToolProvider is implemented by providers that can call tools. Requests to
+// other providers are sent without tools or tool turns.
+type ToolProvider interface {
+	SupportsTools() bool
+}
+
+// VisionProvider is implemented by providers that accept images. Requests
+// with images are only sent to models it reports as supporting them.
+type VisionProvider interface {
+	SupportsVision(model string) bool
+}
+
+// ModelInfo describes a model offered by a provider. Context length and
+// prices are zero when the provider doesn't report them.
+type ModelInfo struct {
+	ID            string
+	ContextLength int
+	// Prices are in US dollars per million tokens
+	PromptPrice     float64
+	CompletionPrice float64
+}
+
+// ModelLister is implemented by providers that can fetch their live model
+// catalog. GetAvailableModels remains the fallback when discovery fails.
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]ModelInfo, error)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// stopSeparator separates stop sequences in the /aiparams stop option
+const stopSeparator = "|"
+
+// aiParamsCommand shows or changes the user's generation parameters
+func (h *aiCommandHandler) aiParamsCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	params, err := userDB.GetGenerationParams(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get preferences: %v", err))
+	}
+
+	// Clearing happens first so that "clear:all temperature:0.3" starts over
+	switch data.Options.Find("clear").String() {
+	case "":
+	case "all":
+		params = GenerationParams{}
+	case "temperature":
+		params.Temperature = nil
+	case "top_p":
+		params.TopP = nil
+	case "max_tokens":
+		params.MaxTokens = 0
+	case "seed":
+		params.Seed = nil
+	case "stop":
+		params.Stop = nil
+	case "reasoning_effort":
+		params.ReasoningEffort = ""
+	}
+
+	if value, err := data.Options.Find("temperature").FloatValue(); err == nil {
+		params.Temperature = &value
+	}
+	if value, err := data.Options.Find("top_p").FloatValue(); err == nil {
+		params.TopP = &value
+	}
+	if value, err := data.Options.Find("max_tokens").IntValue(); err == nil {
+		params.MaxTokens = int(value)
+	}
+	if value, err := data.Options.Find("seed").IntValue(); err == nil {
+		params.Seed = &value
+	}
+	if value := data.Options.Find("stop").String(); value != "" {
+		params.Stop = parseStopSequences(value)
+	}
+	if value := data.Options.Find("reasoning_effort").String(); value != "" {
+		params.ReasoningEffort = value
+	}
+
+	if len(data.Options) > 0 {
+		if err := userDB.SetGenerationParams(userID, params); err != nil {
+			return h.errorResponse(fmt.Sprintf("Cannot save preference: %v", err))
+		}
+	}
+
+	response := "**Your generation parameters:**\n" + formatGenerationParams(params)
+	response += "\nParameters a model doesn't support are ignored. Use `clear:` to go back to the provider default."
+
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(response),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// parseStopSequences splits the stop option on stopSeparator. "\n" can be
+// typed for a newline, which Discord options can't contain.
+func parseStopSequences(value string) []string {
+	var stop []string
+	for _, sequence := range strings.Split(value, stopSeparator) {
+		sequence = strings.ReplaceAll(sequence, `\n`, "\n")
+		if sequence != "" {
+			stop = append(stop, sequence)
+		}
+	}
+	return stop
+}
+
+// formatGenerationParams lists every parameter, showing "default" when unset
+func formatGenerationParams(p GenerationParams) string {
+	value := func(set bool, v string) string {
+		if !set {
+			return "default"
+		}
+		return v
+	}
+
+	var temperature, topP, seed string
+	if p.Temperature != nil {
+		temperature = strconv.FormatFloat(*p.Temperature, 'f', -1, 64)
+	}
+	if p.TopP != nil {
+		topP = strconv.FormatFloat(*p.TopP, 'f', -1, 64)
+	}
+	if p.Seed != nil {
+		seed = strconv.FormatInt(*p.Seed, 10)
+	}
+
+	quoted := make([]string, len(p.Stop))
+	for i, sequence := range p.Stop {
+		quoted[i] = strconv.Quote(sequence)
+	}
+
+	var response string
+	response += fmt.Sprintf("Temperature: %s\n", value(p.Temperature != nil, temperature))
+	response += fmt.Sprintf("Top P: %s\n", value(p.TopP != nil, topP))
+	response += fmt.Sprintf("Max output tokens: %s\n", value(p.MaxTokens > 0, strconv.Itoa(p.MaxTokens)))
+	response += fmt.Sprintf("Seed: %s\n", value(p.Seed != nil, seed))
+	response += fmt.Sprintf("Stop sequences: %s\n", value(len(p.Stop) > 0, strings.Join(quoted, ", ")))
+	response += fmt.Sprintf("Reasoning effort: %s\n", value(p.ReasoningEffort != "", p.ReasoningEffort))
+	return response
+}
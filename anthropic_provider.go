@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicAPIVersion       = "2023-06-01"
+	anthropicDefaultMaxTokens = 4096
+)
+
+type AnthropicProvider struct {
+	apiKey       string
+	defaultModel string
+	maxTokens    int
+	client       *http.Client
+}
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	System        string             `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Thinking      *AnthropicThinking `json:"thinking,omitempty"`
+	Tools         []AnthropicTool    `json:"tools,omitempty"`
+}
+
+// AnthropicTool declares a tool the model may use
+type AnthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+// AnthropicThinking enables extended thinking with a token budget
+type AnthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// anthropicThinkingBudgets maps reasoning effort to a thinking budget in
+// tokens. Minimal leaves extended thinking off.
+var anthropicThinkingBudgets = map[string]int{
+	ReasoningLow:    1024,
+	ReasoningMedium: 4096,
+	ReasoningHigh:   16384,
+}
+
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+type AnthropicResponse struct {
+	ID         string                  `json:"id"`
+	Type       string                  `json:"type"`
+	Model      string                  `json:"model"`
+	Content    []AnthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicContentBlock is a text, tool_use or tool_result block
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// ID, Name and Input describe a tool_use block
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// ToolUseID and Content describe a tool_result block
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// Source is the data of an image block
+	Source *AnthropicImageSource `json:"source,omitempty"`
+}
+
+// AnthropicImageSource is a base64-encoded image
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u AnthropicUsage) toUsage() Usage {
+	return Usage{PromptTokens: u.InputTokens, CompletionTokens: u.OutputTokens}
+}
+
+// AnthropicError is the error body returned by the Messages API
+type AnthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicStreamEvent is a single server-sent event of a streamed message
+type anthropicStreamEvent struct {
+	Type string `json:"type"`
+	// Message is sent with message_start and carries the input token count
+	Message struct {
+		Usage AnthropicUsage `json:"usage"`
+	} `json:"message"`
+	// Usage is sent with message_delta and carries the output token count
+	Usage AnthropicUsage `json:"usage"`
+	// Index and ContentBlock are sent with content_block_start
+	Index        int                   `json:"index"`
+	ContentBlock AnthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicModelList struct {
+	Data []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"display_name"`
+	} `json:"data"`
+}
+
+func NewAnthropicProvider(apiKey, model string, maxTokens int) (*AnthropicProvider, error) {
+	if model == "" {
+		model = "claude-sonnet-4-5"
+	}
+	if maxTokens <= 0 {
+		maxTokens = anthropicDefaultMaxTokens
+	}
+	return &AnthropicProvider{
+		apiKey:       apiKey,
+		defaultModel: model,
+		maxTokens:    maxTokens,
+		client:       &http.Client{},
+	}, nil
+}
+
+func (a *AnthropicProvider) GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := a.send(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+
+	var respData AnthropicResponse
+	if err := json.Unmarshal(respBytes, &respData); err != nil {
+		return ChatResponse{}, err
+	}
+
+	var response strings.Builder
+	var calls []ToolCall
+	for _, block := range respData.Content {
+		switch block.Type {
+		case "text":
+			response.WriteString(block.Text)
+		case "tool_use":
+			calls = append(calls, ToolCall{ID: block.ID, Name: block.Name, Arguments: string(block.Input)})
+		}
+	}
+	if err := a.checkStopReason(respData.StopReason); err != nil {
+		return ChatResponse{}, err
+	}
+
+	usage := respData.Usage.toUsage()
+	if len(calls) > 0 {
+		return ChatResponse{Content: response.String(), ToolCalls: calls, Usage: usage}, nil
+	}
+	if response.Len() == 0 {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	return ChatResponse{Content: response.String(), Usage: usage}, nil
+}
+
+// StreamResponse streams the message over SSE, calling onDelta for each text fragment
+func (a *AnthropicProvider) StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error) {
+	resp, err := a.send(ctx, req, true)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var response strings.Builder
+	var usage AnthropicUsage
+	// Tool inputs arrive as JSON fragments for the block at an index
+	var calls []ToolCall
+	toolBlocks := map[int]int{}
+	err = readSSE(resp.Body, func(data string) (bool, error) {
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return false, fmt.Errorf("invalid stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage.InputTokens = event.Message.Usage.InputTokens
+		case "content_block_start":
+			if event.ContentBlock.Type == "tool_use" {
+				toolBlocks[event.Index] = len(calls)
+				calls = append(calls, ToolCall{ID: event.ContentBlock.ID, Name: event.ContentBlock.Name})
+			}
+		case "content_block_delta":
+			switch {
+			case event.Delta.Type == "text_delta" && event.Delta.Text != "":
+				response.WriteString(event.Delta.Text)
+				onDelta(event.Delta.Text)
+			case event.Delta.Type == "input_json_delta":
+				if i, ok := toolBlocks[event.Index]; ok {
+					calls[i].Arguments += event.Delta.PartialJSON
+				}
+			}
+		case "message_delta":
+			usage.OutputTokens = event.Usage.OutputTokens
+			if err := a.checkStopReason(event.Delta.StopReason); err != nil {
+				return false, err
+			}
+		case "message_stop":
+			return false, nil
+		case "error":
+			return false, &ProviderError{
+				Kind:     anthropicErrorKind(event.Error.Type, event.Error.Message),
+				Provider: a.GetName(),
+				Message:  event.Error.Message,
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return ChatResponse{}, asProviderError(a.GetName(), err)
+	}
+
+	if len(calls) > 0 {
+		return ChatResponse{Content: response.String(), ToolCalls: calls, Usage: usage.toUsage()}, nil
+	}
+	if response.Len() == 0 {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage.toUsage()}, nil
+	}
+
+	return ChatResponse{Content: response.String(), Usage: usage.toUsage()}, nil
+}
+
+// send posts a Messages API request and converts error responses into
+// helpful errors. The caller must close the body of the returned response.
+func (a *AnthropicProvider) send(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	reqBody := AnthropicRequest{
+		Model:     req.modelOr(a.defaultModel),
+		MaxTokens: a.maxTokens,
+		System:    req.System,
+		Messages:  a.buildMessages(req),
+		Stream:    stream,
+	}
+	for _, tool := range req.Tools {
+		reqBody.Tools = append(reqBody.Tools, AnthropicTool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.Parameters,
+		})
+	}
+	a.applyParams(&reqBody, req.Params)
+
+	bodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := a.newRequest(ctx, "POST", "/messages", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return nil, newTransportError(a.GetName(), err)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	errBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	providerErr := newHTTPError(a.GetName(), resp, errBytes)
+	var apiErr AnthropicError
+	if err := json.Unmarshal(errBytes, &apiErr); err == nil && apiErr.Error.Type != "" {
+		providerErr.Kind = anthropicErrorKind(apiErr.Error.Type, apiErr.Error.Message)
+	}
+	if providerErr.Kind == ErrAuth {
+		providerErr.Message += " (check ANTHROPIC_API_KEY in .env)"
+	}
+	return nil, providerErr
+}
+
+// ListModels fetches the models available to the API key
+func (a *AnthropicProvider) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	httpReq, err := a.newRequest(ctx, "GET", "/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return nil, newTransportError(a.GetName(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errBytes, _ := io.ReadAll(resp.Body)
+		return nil, newHTTPError(a.GetName(), resp, errBytes)
+	}
+
+	var list anthropicModelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, ModelInfo{ID: m.ID})
+	}
+	return models, nil
+}
+
+// newRequest creates a Messages API request with the auth and version headers set
+func (a *AnthropicProvider) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, method, "https://api.anthropic.com/v1"+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("X-Api-Key", a.apiKey)
+	httpReq.Header.Set("Anthropic-Version", anthropicAPIVersion)
+	return httpReq, nil
+}
+
+// applyParams copies the user's generation parameters into the request
+func (a *AnthropicProvider) applyParams(reqBody *AnthropicRequest, p GenerationParams) {
+	if p.MaxTokens > 0 {
+		reqBody.MaxTokens = p.MaxTokens
+	}
+	reqBody.StopSequences = p.Stop
+
+	// Thinking with tools would require sending the signed thinking blocks
+	// back with every tool result, so tool requests go without it
+	budget, ok := anthropicThinkingBudgets[p.ReasoningEffort]
+	if ok && anthropicSupportsThinking(reqBody.Model) && len(reqBody.Tools) == 0 {
+		// Thinking counts against max_tokens and doesn't allow sampling changes
+		if reqBody.MaxTokens <= budget {
+			reqBody.MaxTokens = budget + anthropicDefaultMaxTokens
+		}
+		reqBody.Thinking = &AnthropicThinking{Type: "enabled", BudgetTokens: budget}
+		return
+	}
+
+	if p.Temperature != nil {
+		// Anthropic's temperature range is 0 to 1
+		temperature := min(*p.Temperature, 1)
+		reqBody.Temperature = &temperature
+	} else if p.TopP != nil {
+		// Recent models reject temperature and top_p together
+		reqBody.TopP = p.TopP
+	}
+}
+
+// anthropicSupportsThinking reports whether a model has extended thinking,
+// which is every model since Claude 3.7 Sonnet
+func anthropicSupportsThinking(model string) bool {
+	return !strings.HasPrefix(model, "claude-3-") || strings.HasPrefix(model, "claude-3-7")
+}
+
+// anthropicErrorKind maps an Anthropic error type to a failure category
+func anthropicErrorKind(errType, message string) error {
+	switch errType {
+	case "rate_limit_error":
+		return ErrRateLimited
+	case "overloaded_error", "api_error":
+		return ErrUnavailable
+	case "authentication_error":
+		return ErrAuth
+	case "permission_error":
+		return ErrForbiddenModel
+	case "request_too_large":
+		return ErrContextTooLong
+	case "timeout_error":
+		return ErrTimeout
+	default:
+		if isContextTooLong(message) {
+			return ErrContextTooLong
+		}
+		return ErrBadRequest
+	}
+}
+
+// checkStopReason logs responses that were cut off by the max_tokens limit
+// and reports refusals as blocked content
+func (a *AnthropicProvider) checkStopReason(stopReason string) error {
+	switch stopReason {
+	case "max_tokens":
+		log.Printf("Anthropic response truncated at max_tokens=%d (set ANTHROPIC_MAX_TOKENS to raise it)", a.maxTokens)
+	case "refusal":
+		return &ProviderError{Kind: ErrContentBlocked, Provider: a.GetName(), Message: "the model refused to continue"}
+	}
+	return nil
+}
+
+// buildMessages maps the conversation turns to Anthropic messages. The system
+// prompt is sent separately as the top-level system field, and tool results
+// are tool_result blocks in a user turn.
+func (a *AnthropicProvider) buildMessages(req ChatRequest) []AnthropicMessage {
+	messages := make([]AnthropicMessage, 0, len(req.Messages))
+	// IDs of the tool_use blocks sent so far; a tool_result must follow its
+	// tool_use, so results of calls that were dropped are dropped too
+	toolUses := make(map[string]bool)
+	for _, msg := range req.Messages {
+		// The Messages API requires the conversation to start with a user turn
+		if len(messages) == 0 && msg.Role != RoleUser {
+			continue
+		}
+
+		role := msg.Role
+		var blocks []AnthropicContentBlock
+		if msg.Role == RoleTool {
+			if !toolUses[msg.ToolCallID] {
+				continue
+			}
+			role = RoleUser
+			blocks = append(blocks, AnthropicContentBlock{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content})
+		} else {
+			// Images go first, which Anthropic recommends
+			for _, image := range msg.Images {
+				blocks = append(blocks, AnthropicContentBlock{Type: "image", Source: &AnthropicImageSource{
+					Type:      "base64",
+					MediaType: image.MIMEType,
+					Data:      base64.StdEncoding.EncodeToString(image.Data),
+				}})
+			}
+			if msg.Content != "" {
+				blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				input := json.RawMessage(call.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, AnthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: input})
+				toolUses[call.ID] = true
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Consecutive turns of the same role, such as several tool results,
+		// go in one message
+		if last := len(messages) - 1; last >= 0 && messages[last].Role == role {
+			messages[last].Content = append(messages[last].Content, blocks...)
+			continue
+		}
+		messages = append(messages, AnthropicMessage{Role: role, Content: blocks})
+	}
+	return messages
+}
+
+// SupportsVision reports that Claude models accept images
+func (a *AnthropicProvider) SupportsVision(model string) bool {
+	return true
+}
+
+// SupportsTools reports that Claude models can use tools
+func (a *AnthropicProvider) SupportsTools() bool {
+	return true
+}
+
+func (a *AnthropicProvider) GetName() string {
+	return "Anthropic"
+}
+
+func (a *AnthropicProvider) GetDefaultModel() string {
+	return a.defaultModel
+}
+
+func (a *AnthropicProvider) GetAvailableModels() []string {
+	return []string{
+		"claude-opus-4-5",
+		"claude-sonnet-4-5",
+		"claude-haiku-4-5",
+	}
+}
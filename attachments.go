@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+const (
+	// DefaultImageMaxMB is the largest image accepted, in megabytes. Anthropic
+	// caps images at 5 MB; the other providers allow more.
+	DefaultImageMaxMB = 5
+	// MaxImagesPerMessage limits how many images one message may carry
+	MaxImagesPerMessage = 4
+
+	attachmentTimeout = 30 * time.Second
+)
+
+// AttachmentImage is the Attachment kind of images
+const AttachmentImage = "image"
+
+// Attachment records a file that was part of a turn. Only this description
+// is stored in the history, not the file itself.
+type Attachment struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	MIMEType string `json:"mime_type"`
+	Size     int    `json:"size"`
+}
+
+// imageTypes are the image formats every vision provider accepts
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var attachmentClient = &http.Client{Timeout: attachmentTimeout}
+
+// imageMaxBytes reads IMAGE_MAX_MB, falling back to DefaultImageMaxMB
+func imageMaxBytes() int64 {
+	mb, err := strconv.ParseFloat(os.Getenv("IMAGE_MAX_MB"), 64)
+	if err != nil || mb <= 0 {
+		mb = DefaultImageMaxMB
+	}
+	return int64(mb * 1024 * 1024)
+}
+
+// downloadImages fetches the image attachments of a message. Other files are
+// skipped. The error explains to the user which image couldn't be used.
+func downloadImages(ctx context.Context, attachments []discord.Attachment) ([]ImagePart, error) {
+	maxBytes := imageMaxBytes()
+
+	var images []ImagePart
+	for _, attachment := range attachments {
+		mimeType, _, _ := strings.Cut(attachment.ContentType, ";")
+		if !strings.HasPrefix(mimeType, "image/") {
+			continue
+		}
+		if !imageTypes[mimeType] {
+			return nil, fmt.Errorf("%s is a %s image; only PNG, JPEG, GIF and WebP are supported", attachment.Filename, mimeType)
+		}
+		if len(images) == MaxImagesPerMessage {
+			return nil, fmt.Errorf("at most %d images can be sent in one message", MaxImagesPerMessage)
+		}
+		if int64(attachment.Size) > maxBytes {
+			return nil, fmt.Errorf("%s is %s; images can be at most %s", attachment.Filename, formatBytes(int64(attachment.Size)), formatBytes(maxBytes))
+		}
+
+		data, err := downloadAttachment(ctx, attachment.URL, maxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not download %s: %w", attachment.Filename, err)
+		}
+		images = append(images, ImagePart{Name: attachment.Filename, MIMEType: mimeType, Data: data})
+	}
+	return images, nil
+}
+
+// downloadAttachment fetches a file from Discord's CDN, refusing anything
+// larger than maxBytes
+func downloadAttachment(ctx context.Context, url string, maxBytes int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := attachmentClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("the file is larger than %s", formatBytes(maxBytes))
+	}
+	return data, nil
+}
+
+// imageAttachments describes images for the history
+func imageAttachments(images []ImagePart) []Attachment {
+	attachments := make([]Attachment, len(images))
+	for i, image := range images {
+		attachments[i] = Attachment{Kind: AttachmentImage, Name: image.Name, MIMEType: image.MIMEType, Size: len(image.Data)}
+	}
+	return attachments
+}
+
+// attachmentNote describes the attachments of a past turn to the model, whose
+// files are no longer sent
+func attachmentNote(attachments []Attachment) string {
+	var note strings.Builder
+	for _, attachment := range attachments {
+		fmt.Fprintf(&note, "[Attached %s: %s]\n", attachment.Kind, attachment.Name)
+	}
+	return note.String()
+}
+
+// formatBytes renders a size for users, e.g. "4.2 MB"
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+)
+
+// maxBranchPreview bounds the last reply shown when switching branches
+const maxBranchPreview = 1500
+
+// branchesCommand lists the branches of the conversation active in the
+// channel, or continues another one of them when an id is given
+func (h *aiCommandHandler) branchesCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	db, err := h.channelHistoryDB(data)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	channelID := data.Event.ChannelID.String()
+	active, err := db.ActiveConversation(channelID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get conversation: %v", err))
+	}
+	branches, err := db.Branches(active.ID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot list branches: %v", err))
+	}
+
+	if id, err := data.Options.Find("id").IntValue(); err == nil {
+		i := slices.IndexFunc(branches, func(branch Conversation) bool { return branch.ID == id })
+		if i < 0 {
+			return h.errorResponse(fmt.Sprintf("#%d is not a branch of this conversation. See `/branches`.", id))
+		}
+		if err := db.SetActiveConversation(channelID, id); err != nil {
+			return h.errorResponse(fmt.Sprintf("Cannot switch branch: %v", err))
+		}
+		return h.chatResponse(branchSwitched(db, branches[i]))
+	}
+
+	if len(branches) < 2 {
+		return h.chatResponse("This conversation has no other branches. Editing one of your messages starts a branch from it.")
+	}
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "**Branches of %s:**\n", formatConversationTitle(active))
+	for i, branch := range branches {
+		if i == maxConversationRows {
+			fmt.Fprintf(&response, "…and %d newer branches\n", len(branches)-i)
+			break
+		}
+		fmt.Fprintf(&response, "• `#%d` ", branch.ID)
+		if branch.ParentID == 0 {
+			response.WriteString("original")
+		} else {
+			fmt.Fprintf(&response, "from `#%d`", branch.ParentID)
+			if prompt := branchPrompt(db, branch); prompt != "" {
+				fmt.Fprintf(&response, ": “%s”", prompt)
+			}
+		}
+		fmt.Fprintf(&response, " — %s, <t:%d:R>", pluralize(branch.Messages, "message"), branch.UpdatedAt.Unix())
+		if branch.ID == active.ID {
+			response.WriteString(" **(active here)**")
+		}
+		response.WriteString("\n")
+	}
+	response.WriteString("\nUse `/branches` with an id to continue another branch in this channel.")
+
+	return h.chatResponse(response.String())
+}
+
+// channelHistoryDB returns the history of the channel a command was used
+// in: the shared one of a thread, or the user's own
+func (h *aiCommandHandler) channelHistoryDB(data cmdroute.CommandData) (*DBService, error) {
+	return channelHistory(h.dbManager, data.Event.ChannelID, data.Event.SenderID())
+}
+
+// channelHistory returns the history a user's messages in a channel go to
+func channelHistory(dbManager *DatabaseManager, channelID discord.ChannelID, userID discord.UserID) (*DBService, error) {
+	if inThread(channelID) {
+		return dbManager.GetThreadDB(channelID.String())
+	}
+	return dbManager.GetUserDB(userID.String())
+}
+
+// inThread reports whether a channel is a thread, whose history is shared
+func inThread(channelID discord.ChannelID) bool {
+	ch, err := botState.Channel(channelID)
+	return err == nil && isThread(ch)
+}
+
+// branchPrompt returns the message a branch starts with, shortened to its
+// last line, since files and web pages are read in ahead of the text
+func branchPrompt(db *DBService, branch Conversation) string {
+	messages, err := db.GetMessages(branch.ID)
+	if err != nil || branch.BranchPoint >= len(messages) {
+		return ""
+	}
+	text := strings.TrimSpace(messages[branch.BranchPoint].Content)
+	if i := strings.LastIndex(text, "\n"); i >= 0 {
+		text = text[i+1:]
+	}
+	return truncate(text, 80)
+}
+
+// branchSwitched confirms a switch and shows where the branch left off
+func branchSwitched(db *DBService, branch Conversation) string {
+	response := fmt.Sprintf("Switched to branch #%d (%s).", branch.ID, pluralize(branch.Messages, "message"))
+
+	messages, err := db.GetMessages(branch.ID)
+	if err != nil {
+		return response
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if msg := messages[i]; msg.Role == RoleAssistant && len(msg.ToolCalls) == 0 {
+			quoted := "> " + strings.ReplaceAll(truncate(msg.Content, maxBranchPreview), "\n", "\n> ")
+			return response + " Its last reply:\n" + quoted
+		}
+	}
+	return response
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// maxConversationRows keeps /chat list inside one Discord message
+const maxConversationRows = 25
+
+// chatNewCommand starts a conversation and makes it active in the channel.
+// In a thread it starts one in the thread's shared history.
+func (h *aiCommandHandler) chatNewCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userDB, err := h.channelHistoryDB(data)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	title := conversationTitle(data.Options.Find("title").String())
+	conversation, err := userDB.CreateConversation(title)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot create conversation: %v", err))
+	}
+	if err := userDB.SetActiveConversation(data.Event.ChannelID.String(), conversation.ID); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot switch conversation: %v", err))
+	}
+
+	response := fmt.Sprintf("Started conversation #%d. Your next message in this channel begins it.", conversation.ID)
+	if title != "" {
+		response = fmt.Sprintf("Started conversation #%d **%s**. Your next message in this channel begins it.", conversation.ID, title)
+	}
+	return h.chatResponse(response)
+}
+
+// chatListCommand lists the conversations of the channel's history, the
+// user's own or a thread's, marking the active one
+func (h *aiCommandHandler) chatListCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userDB, err := h.channelHistoryDB(data)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	conversations, err := userDB.ListConversations()
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot list conversations: %v", err))
+	}
+	thread := inThread(data.Event.ChannelID)
+	if len(conversations) == 0 {
+		if thread {
+			return h.chatResponse("This thread has no conversations yet. Send a message or use `/chat new` to start one.")
+		}
+		return h.chatResponse("You have no conversations yet. Send a message or use `/chat new` to start one.")
+	}
+	active, err := userDB.ActiveConversation(data.Event.ChannelID.String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get conversation: %v", err))
+	}
+
+	var response strings.Builder
+	if thread {
+		response.WriteString("**Conversations of this thread:**\n")
+	} else {
+		response.WriteString("**Your conversations:**\n")
+	}
+	for i, conversation := range conversations {
+		if i == maxConversationRows {
+			fmt.Fprintf(&response, "…and %d older conversations\n", len(conversations)-i)
+			break
+		}
+		fmt.Fprintf(&response, "• `#%d` %s — %s, <t:%d:R>", conversation.ID, formatConversationTitle(conversation),
+			pluralize(conversation.Messages, "message"), conversation.UpdatedAt.Unix())
+		if conversation.ParentID != 0 {
+			fmt.Fprintf(&response, " (branch of `#%d`)", conversation.ParentID)
+		}
+		if conversation.ID == active.ID {
+			response.WriteString(" **(active here)**")
+		}
+		response.WriteString("\n")
+	}
+	response.WriteString("\nUse `/chat switch` with a number to continue a conversation in this channel.")
+
+	return h.chatResponse(response.String())
+}
+
+// chatSwitchCommand makes a conversation of the channel's history active in it
+func (h *aiCommandHandler) chatSwitchCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userDB, err := h.channelHistoryDB(data)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	conversation, denied := h.findConversation(userDB, data)
+	if denied != nil {
+		return denied
+	}
+	if err := userDB.SetActiveConversation(data.Event.ChannelID.String(), conversation.ID); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot switch conversation: %v", err))
+	}
+
+	return h.chatResponse(fmt.Sprintf("Switched to conversation #%d %s (%s).", conversation.ID,
+		formatConversationTitle(conversation), pluralize(conversation.Messages, "message")))
+}
+
+// chatDeleteCommand deletes a conversation and its messages. Threads are
+// shared, so it isn't offered in them.
+func (h *aiCommandHandler) chatDeleteCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	if inThread(data.Event.ChannelID) {
+		return h.errorResponse("The conversations of a thread are shared and cannot be deleted. Use `/chat delete` outside the thread for your own.")
+	}
+
+	userDB, err := h.dbManager.GetUserDB(data.Event.SenderID().String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	conversation, denied := h.findConversation(userDB, data)
+	if denied != nil {
+		return denied
+	}
+	if err := userDB.DeleteConversation(conversation.ID); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot delete conversation: %v", err))
+	}
+
+	return h.chatResponse(fmt.Sprintf("Deleted conversation #%d %s. Channels where it was active continue your most recent conversation.",
+		conversation.ID, formatConversationTitle(conversation)))
+}
+
+// findConversation looks up the conversation named by the id option
+func (h *aiCommandHandler) findConversation(userDB *DBService, data cmdroute.CommandData) (Conversation, *api.InteractionResponseData) {
+	id, err := data.Options.Find("id").IntValue()
+	if err != nil {
+		return Conversation{}, h.errorResponse("Give the number of a conversation from `/chat list`.")
+	}
+
+	conversation, err := userDB.GetConversation(id)
+	if err == sql.ErrNoRows {
+		return Conversation{}, h.errorResponse(fmt.Sprintf("There is no conversation #%d here. See `/chat list`.", id))
+	}
+	if err != nil {
+		return Conversation{}, h.errorResponse(fmt.Sprintf("Cannot get conversation: %v", err))
+	}
+	return conversation, nil
+}
+
+// chatResponse is a private reply to a /chat command
+func (h *aiCommandHandler) chatResponse(content string) *api.InteractionResponseData {
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(truncate(content, MaxMessageLength)),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// formatConversationTitle renders a title in bold, or a placeholder while the
+// first exchange hasn't named the conversation yet
+func formatConversationTitle(conversation Conversation) string {
+	if conversation.Title == "" {
+		return "*untitled*"
+	}
+	return "**" + conversation.Title + "**"
+}
+
+// pluralize renders a count with its noun, e.g. "1 message" or "3 messages"
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -14,15 +14,17 @@ import (
 
 var botState *state.State
 
-func RegisterCommands(router *cmdroute.Router, s *state.State, dbManager *DatabaseManager) {
+func RegisterCommands(router *cmdroute.Router, s *state.State, dbManager *DatabaseManager, quotas *QuotaService) {
 	botState = s
 	router.AddFunc("ping", pingCommand)
 	router.AddFunc("clear", clearCommand)
 	router.AddFunc("ticket", ticketCommand)
 	router.AddFunc("ai", aiCommand)
+	router.AddFunc("thread", threadCommand)
 	router.AddFunc("deletedata", deleteDataCommand)
 	router.AddFunc("clearhistory", clearHistoryCommand)
 	RegisterAICommands(router, dbManager, mlService)
+	RegisterQuotaCommands(router, quotas)
 }
 
 func pingCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
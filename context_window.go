@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultContextMaxTokens caps the prompt of every request, so that long
+	// histories don't make each message expensive
+	DefaultContextMaxTokens = 16000
+	// defaultContextWindow is assumed for models whose window is unknown
+	defaultContextWindow = 32000
+	// outputReserveTokens is left free for the response when the user hasn't
+	// set max_tokens
+	outputReserveTokens = 4096
+	// imageTokens is roughly what one image costs in a prompt
+	imageTokens = 1000
+	// messageOverheadTokens covers the role and formatting of each turn
+	messageOverheadTokens = 4
+	// summaryMaxTokens bounds the running summary, and is reserved for it in
+	// every budget
+	summaryMaxTokens = 1000
+	// summaryTurnChars cuts long turns before they are summarized
+	summaryTurnChars = 4000
+)
+
+// SummaryPrompt instructs the model that rolls old turns into the summary
+const SummaryPrompt = `You maintain a running summary of a conversation between a user and an AI assistant. You are given the current summary, which may be empty, and the turns that follow it. Write an updated summary that keeps the facts, decisions, preferences, open questions and names the assistant needs to continue the conversation. Drop small talk and details that no longer matter. Write plain prose or short bullet points, at most 400 words, and reply with the summary only.`
+
+// ContextPolicy decides how much history goes into a request and which model
+// summarizes the turns that no longer fit
+type ContextPolicy struct {
+	// MaxTokens caps the prompt for every model
+	MaxTokens int
+	// Budgets replace MaxTokens for the models whose ID contains the key
+	Budgets map[string]int
+	// Summarizer writes the running summary; an empty Provider uses the
+	// user's model
+	Summarizer FailoverTarget
+}
+
+// contextPolicyFromEnv reads CONTEXT_MAX_TOKENS, CONTEXT_BUDGETS and SUMMARY_MODEL
+func contextPolicyFromEnv() (ContextPolicy, error) {
+	policy := ContextPolicy{MaxTokens: DefaultContextMaxTokens, Budgets: map[string]int{}}
+
+	if value := os.Getenv("CONTEXT_MAX_TOKENS"); value != "" {
+		tokens, err := strconv.Atoi(value)
+		if err != nil || tokens <= 0 {
+			return policy, fmt.Errorf("CONTEXT_MAX_TOKENS: invalid token count %q", value)
+		}
+		policy.MaxTokens = tokens
+	}
+
+	// Comma-separated model=tokens entries, e.g. "gpt-4o=64000,claude=100000"
+	for _, entry := range splitList(os.Getenv("CONTEXT_BUDGETS")) {
+		model, value, _ := strings.Cut(entry, "=")
+		tokens, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || tokens <= 0 || strings.TrimSpace(model) == "" {
+			return policy, fmt.Errorf("CONTEXT_BUDGETS: invalid entry %q", entry)
+		}
+		policy.Budgets[strings.ToLower(strings.TrimSpace(model))] = tokens
+	}
+
+	if chain := parseFailoverChain(os.Getenv("SUMMARY_MODEL")); len(chain) > 0 {
+		policy.Summarizer = chain[0]
+	}
+
+	return policy, nil
+}
+
+// contextWindows are the context lengths of well-known model families, for
+// providers whose catalog doesn't report them. More specific names go first.
+var contextWindows = []struct {
+	match  string
+	tokens int
+}{
+	{"gpt-3.5", 16_385},
+	{"gpt-4.1", 1_047_576},
+	{"gpt-4o", 128_000},
+	{"gpt-5", 400_000},
+	{"o1", 200_000},
+	{"o3", 200_000},
+	{"o4", 200_000},
+	{"claude", 200_000},
+	{"gemini", 1_048_576},
+	{"codestral", 256_000},
+	{"pixtral", 128_000},
+	{"mistral-large", 128_000},
+	{"mistral-medium", 128_000},
+	{"mistral-small", 128_000},
+	{"mistral", 32_000},
+}
+
+// contextWindow returns the context length of a model: the catalog's when it
+// reports one, else that of its family
+func (ml *MLService) contextWindow(target FailoverTarget) int {
+	if info, ok := ml.catalog.Find(target.Provider, ml.providers[target.Provider], target.Model); ok && info.ContextLength > 0 {
+		return info.ContextLength
+	}
+
+	model := strings.ToLower(target.Model)
+	for _, window := range contextWindows {
+		if strings.Contains(model, window.match) {
+			return window.tokens
+		}
+	}
+	return defaultContextWindow
+}
+
+// contextBudget returns how many prompt tokens a request to target may use:
+// the model's window less room for the response, capped by the policy
+func (ml *MLService) contextBudget(target FailoverTarget, params GenerationParams) int {
+	reserve := outputReserveTokens
+	if params.MaxTokens > 0 {
+		reserve = params.MaxTokens
+	}
+
+	// The longest matching budget key is the most specific
+	limit, matched := ml.contextPolicy.MaxTokens, ""
+	model := strings.ToLower(target.Model)
+	for key, tokens := range ml.contextPolicy.Budgets {
+		if strings.Contains(model, key) && len(key) > len(matched) {
+			limit, matched = tokens, key
+		}
+	}
+
+	return min(ml.contextWindow(target)-reserve, limit)
+}
+
+// fitContext leaves out the oldest turns that don't fit in the context budget
+// of the primary target, after the system prompt, and folds them into the
+// running summary. It returns the turns to send and the summary that goes
+// ahead of them.
+func (ml *MLService) fitContext(ctx context.Context, user ChatUser, db *DBService, conversationID int64, history []Message, primary FailoverTarget, params GenerationParams, system string, images int) ([]Message, string) {
+	summary, err := db.GetSummary(conversationID)
+	if err != nil {
+		fmt.Printf("Warning: could not get conversation summary: %v\n", err)
+	}
+
+	// Turns already in the summary aren't sent again
+	start := slices.IndexFunc(history, func(msg Message) bool { return msg.ID > summary.ThroughID })
+	if start < 0 {
+		start = len(history)
+	}
+	history = history[start:]
+
+	budget := ml.contextBudget(primary, params) - estimateTokens(system) - summaryMaxTokens - images*imageTokens
+	older, recent := splitHistory(history, budget)
+	if len(older) == 0 {
+		return recent, summary.Content
+	}
+
+	updated, usage, err := ml.summarize(ctx, summary.Content, older, primary)
+	if err != nil {
+		// The turns are left out this time and summarized on a later turn
+		fmt.Printf("Warning: could not summarize conversation: %v\n", err)
+		return recent, summary.Content
+	}
+
+	if err := db.SetSummary(conversationID, updated, older[len(older)-1].ID); err != nil {
+		fmt.Printf("Warning: failed to save conversation summary: %v\n", err)
+	}
+	ml.recordUsage(user, usage)
+	return recent, updated
+}
+
+// splitHistory returns the newest turns that fit in budget, and the older
+// ones before them. Once the history is over budget only half of it is kept,
+// so that the summary isn't rewritten on every message. The history is only
+// cut before a user turn, which keeps tool calls with their results, and the
+// last user turn is always kept.
+func splitHistory(history []Message, budget int) (older, recent []Message) {
+	total := 0
+	for _, msg := range history {
+		total += messageTokens(msg)
+	}
+	if total <= budget {
+		return nil, history
+	}
+
+	cut, used := len(history), 0
+	for i := len(history) - 1; i >= 0; i-- {
+		used += messageTokens(history[i])
+		if history[i].Role != RoleUser {
+			continue
+		}
+		if used > budget/2 && cut < len(history) {
+			break
+		}
+		cut = i
+	}
+	if cut == len(history) {
+		return nil, history
+	}
+	return history[:cut], history[cut:]
+}
+
+// messageTokens estimates what a turn costs in a prompt
+func messageTokens(msg Message) int {
+	tokens := messageOverheadTokens + estimateTokens(attachmentNote(msg.Attachments)+msg.Content)
+	for _, call := range msg.ToolCalls {
+		tokens += estimateTokens(call.Name + call.Arguments)
+	}
+	return tokens
+}
+
+// summarize rolls turns into the running summary with the summary model,
+// falling back to the user's model
+func (ml *MLService) summarize(ctx context.Context, summary string, turns []Message, primary FailoverTarget) (string, UsageRecord, error) {
+	var transcript strings.Builder
+	for _, msg := range turns {
+		content := attachmentNote(msg.Attachments) + msg.Content
+		for _, call := range msg.ToolCalls {
+			content += fmt.Sprintf("\n[called %s(%s)]", call.Name, call.Arguments)
+		}
+		switch msg.Role {
+		case RoleUser:
+			fmt.Fprintf(&transcript, "User: %s\n\n", truncate(content, summaryTurnChars))
+		case RoleAssistant:
+			fmt.Fprintf(&transcript, "Assistant: %s\n\n", truncate(content, summaryTurnChars))
+		case RoleTool:
+			fmt.Fprintf(&transcript, "[%s result] %s\n\n", msg.ToolName, truncate(content, summaryTurnChars))
+		}
+	}
+
+	if summary == "" {
+		summary = "(empty)"
+	}
+	req := ChatRequest{
+		System: SummaryPrompt,
+		Messages: []ChatMessage{{
+			Role:    RoleUser,
+			Content: fmt.Sprintf("Current summary:\n%s\n\nNew turns:\n%s", summary, transcript.String()),
+		}},
+		Params: GenerationParams{MaxTokens: summaryMaxTokens},
+	}
+
+	result, err := ml.callWithFailover(ctx, req, ml.summaryTargets(primary), nil)
+	if err != nil {
+		return "", UsageRecord{}, err
+	}
+	updated := strings.TrimSpace(result.Content)
+	if updated == "" || updated == "Sorry, I cannot respond to this." {
+		return "", UsageRecord{}, fmt.Errorf("%s returned an empty summary", result.Target)
+	}
+	return updated, ml.usageRecord(result), nil
+}
+
+// summaryTargets returns the models that write summaries and titles: the
+// summary model, falling back to the user's model
+func (ml *MLService) summaryTargets(primary FailoverTarget) []FailoverTarget {
+	summarizer := ml.contextPolicy.Summarizer
+	if summarizer.Provider == "" {
+		return []FailoverTarget{primary}
+	}
+
+	model, err := ml.ResolveModel(summarizer.Provider, summarizer.Model)
+	if err != nil {
+		fmt.Printf("Warning: skipping summary model %s: %v\n", summarizer, err)
+		return []FailoverTarget{primary}
+	}
+	summarizer.Model = model
+	if summarizer == primary {
+		return []FailoverTarget{primary}
+	}
+	return []FailoverTarget{summarizer, primary}
+}
+
+// summaryContext is the system prompt section holding the running summary
+func summaryContext(summary string) string {
+	return "\n\nSummary of the earlier conversation, whose messages are no longer shown:\n" + summary
+}
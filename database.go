@@ -1,7 +1,11 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,6 +16,85 @@ type DBService struct {
 	db *sql.DB
 }
 
+// UsageRecord is the accounting stored for one AI response
+type UsageRecord struct {
+	Provider         string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Cost is in US dollars, zero when unknown
+	Cost    float64
+	Latency time.Duration
+}
+
+// Conversation is a named thread of messages. Each user can keep several and
+// has one active per channel.
+type Conversation struct {
+	ID        int64
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Messages  int
+	// ParentID is the conversation a branch was forked from, 0 for others
+	ParentID int64
+	// BranchPoint is the number of messages a branch kept from its parent
+	BranchPoint int
+}
+
+// UserTurn is a user message found by the Discord message it came from
+type UserTurn struct {
+	ID             int64
+	ConversationID int64
+	Content        string
+	// ReplyDiscordIDs are the Discord messages of the reply that answered it
+	ReplyDiscordIDs []string
+}
+
+// SearchResult is a message found by SearchMessages
+type SearchResult struct {
+	MessageID      int64
+	ConversationID int64
+	Title          string
+	Role           string
+	UserName       string
+	// Snippet is the part of the message around the matches, which are in bold
+	Snippet string
+	Time    time.Time
+}
+
+// Persona is a named system prompt the user can talk to the AI through
+type Persona struct {
+	ID        int64
+	Name      string
+	Prompt    string
+	UpdatedAt time.Time
+}
+
+// Pruned counts what ApplyRetention removed
+type Pruned struct {
+	Messages      int
+	Conversations int
+}
+
+// Summary is the running summary of the turns that no longer fit in the
+// context window
+type Summary struct {
+	Content string
+	// ThroughID is the last message the summary covers
+	ThroughID int64
+}
+
+// UsageTotal sums the usage of the responses sharing a key, e.g. a day or a model
+type UsageTotal struct {
+	Key              string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// Latency is the average response time
+	Latency time.Duration
+}
+
 func NewDB(dataSourceName string) (*DBService, error) {
 	db, err := sql.Open("sqlite", dataSourceName)
 	if err != nil {
@@ -80,18 +163,900 @@ func (s *DBService) createTables() error {
 		}
 	}
 
+	// Usage of every AI response. Rows outlive /clearhistory so that totals
+	// stay accurate; message_id points at the response while it exists.
+	usageQuery := `
+	CREATE TABLE IF NOT EXISTS usage (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER,
+		provider TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		cost REAL NOT NULL DEFAULT 0,
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);`
+	if _, err := s.db.Exec(usageQuery); err != nil {
+		return err
+	}
+
+	// Generation parameters; NULL or empty keeps the provider default
+	for _, column := range []string{
+		`temperature REAL`,
+		`top_p REAL`,
+		`max_tokens INTEGER`,
+		`seed INTEGER`,
+		`stop_sequences TEXT NOT NULL DEFAULT ''`,
+		`reasoning_effort TEXT NOT NULL DEFAULT ''`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE user_preferences ADD COLUMN ` + column); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+
+	// Tool turns: an assistant message lists its calls as JSON, and each
+	// result is a "tool" message naming the call it answers
+	for _, column := range []string{
+		`tool_calls TEXT NOT NULL DEFAULT ''`,
+		`tool_call_id TEXT NOT NULL DEFAULT ''`,
+		`tool_name TEXT NOT NULL DEFAULT ''`,
+		// JSON descriptions of the files attached to a user turn
+		`attachments TEXT NOT NULL DEFAULT ''`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE messages ADD COLUMN ` + column); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+
+	// The Discord messages a turn came from or is shown in, and for replies
+	// the provider and model that wrote them and the user's rating (1 or
+	// -1) from the reply buttons
+	for _, column := range []string{
+		`discord_message_ids TEXT NOT NULL DEFAULT ''`,
+		`provider TEXT NOT NULL DEFAULT ''`,
+		`model TEXT NOT NULL DEFAULT ''`,
+		`feedback INTEGER`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE messages ADD COLUMN ` + column); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+
+	// Running summary of the oldest turns of each conversation
+	summaryQuery := `
+	CREATE TABLE IF NOT EXISTS summary (
+		content TEXT NOT NULL,
+		through_id INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);`
+	if _, err := s.db.Exec(summaryQuery); err != nil {
+		return err
+	}
+
+	// Comma-separated provider[:model] list, empty to use the admin's chain
+	alterFailoverQuery := `ALTER TABLE user_preferences ADD COLUMN failover_chain TEXT NOT NULL DEFAULT ''`
+	if _, err := s.db.Exec(alterFailoverQuery); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+
+	// Conversations group the messages; active_conversations holds the
+	// conversation picked in each channel
+	conversationsQuery := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS active_conversations (
+		channel_id TEXT PRIMARY KEY,
+		conversation_id INTEGER NOT NULL
+	);`
+	if _, err := s.db.Exec(conversationsQuery); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"messages", "summary"} {
+		if _, err := s.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN conversation_id INTEGER NOT NULL DEFAULT 0`); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS messages_conversation ON messages (conversation_id, timestamp)`); err != nil {
+		return err
+	}
+
+	// Branches are conversations forked from another one when a message is
+	// edited, keeping the messages before the edited one
+	for _, column := range []string{
+		`parent_id INTEGER NOT NULL DEFAULT 0`,
+		`branch_point INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE conversations ADD COLUMN ` + column); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+
+	// The user's own history retention limits, 0 for none; see RetentionPolicy
+	for _, column := range []string{
+		`retention_days INTEGER NOT NULL DEFAULT 0`,
+		`retention_messages INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if _, err := s.db.Exec(`ALTER TABLE user_preferences ADD COLUMN ` + column); err != nil {
+			if !strings.Contains(err.Error(), "duplicate column name") {
+				return err
+			}
+		}
+	}
+
+	// Personas are named system prompts; persona_id is the one in use, 0
+	// for the default prompt
+	personasQuery := `
+	CREATE TABLE IF NOT EXISTS personas (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		prompt TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	);`
+	if _, err := s.db.Exec(personasQuery); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`ALTER TABLE user_preferences ADD COLUMN persona_id INTEGER NOT NULL DEFAULT 0`); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+
+	if err := s.createSearchIndex(); err != nil {
+		return err
+	}
+
+	return s.migrateConversations()
+}
+
+// createSearchIndex sets up messages_fts, the full-text index of the messages
+// used by /search. Triggers keep it in step with the messages table; history
+// from before the index existed is indexed when it is created.
+func (s *DBService) createSearchIndex() error {
+	var exists bool
+	if err := s.db.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+
+	indexQuery := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		content, content='messages', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+	);
+	CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+	END;`
+	if _, err := s.db.Exec(indexQuery); err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := s.db.Exec(`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// migrateConversations moves the history from before conversations existed
+// into a conversation of its own
+func (s *DBService) migrateConversations() error {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = 0`).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	result, err := tx.Exec(`INSERT INTO conversations (title, created_at, updated_at) VALUES (?, ?, ?)`, "Earlier conversation", now, now)
+	if err != nil {
+		return err
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"messages", "summary"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET conversation_id = ? WHERE conversation_id = 0`, conversationID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateConversation starts a conversation; an empty title is filled in
+// after the first exchange
+func (s *DBService) CreateConversation(title string) (Conversation, error) {
+	now := time.Now()
+	result, err := s.db.Exec(`INSERT INTO conversations (title, created_at, updated_at) VALUES (?, ?, ?)`, title, now.Unix(), now.Unix())
+	if err != nil {
+		return Conversation{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Conversation{}, err
+	}
+	return Conversation{ID: id, Title: title, CreatedAt: now, UpdatedAt: now}, nil
+}
+
+// GetConversation returns a conversation by ID, or sql.ErrNoRows
+func (s *DBService) GetConversation(id int64) (Conversation, error) {
+	conversations, err := s.queryConversations(`WHERE c.id = ?`, id)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if len(conversations) == 0 {
+		return Conversation{}, sql.ErrNoRows
+	}
+	return conversations[0], nil
+}
+
+// ListConversations returns every conversation, most recently used first
+func (s *DBService) ListConversations() ([]Conversation, error) {
+	return s.queryConversations(``)
+}
+
+// queryConversations loads conversations with their message counts
+func (s *DBService) queryConversations(where string, args ...any) ([]Conversation, error) {
+	query := `SELECT c.id, c.title, c.created_at, c.updated_at, c.parent_id, c.branch_point,
+	                 (SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id AND m.role IN ('user', 'assistant') AND m.tool_calls = '')
+	          FROM conversations c ` + where + ` ORDER BY c.updated_at DESC, c.id DESC`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var conversation Conversation
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&conversation.ID, &conversation.Title, &createdAt, &updatedAt, &conversation.ParentID, &conversation.BranchPoint, &conversation.Messages); err != nil {
+			return nil, err
+		}
+		conversation.CreatedAt = time.Unix(createdAt, 0)
+		conversation.UpdatedAt = time.Unix(updatedAt, 0)
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// SetConversationTitle renames a conversation
+func (s *DBService) SetConversationTitle(id int64, title string) error {
+	_, err := s.db.Exec(`UPDATE conversations SET title = ? WHERE id = ?`, title, id)
+	return err
+}
+
+// DeleteConversation deletes a conversation along with its messages and summary
+func (s *DBService) DeleteConversation(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM messages WHERE conversation_id = ?`,
+		`DELETE FROM summary WHERE conversation_id = ?`,
+		`DELETE FROM active_conversations WHERE conversation_id = ?`,
+		`DELETE FROM conversations WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ActiveConversation returns the conversation picked in a channel. Channels
+// without one continue the most recently used conversation, and a first
+// conversation is started when there is none.
+func (s *DBService) ActiveConversation(channelID string) (Conversation, error) {
+	var id int64
+	err := s.db.QueryRow(`SELECT conversation_id FROM active_conversations WHERE channel_id = ?`, channelID).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return Conversation{}, err
+	}
+	if err == nil {
+		conversation, err := s.GetConversation(id)
+		if err != sql.ErrNoRows {
+			return conversation, err
+		}
+	}
+
+	conversations, err := s.ListConversations()
+	if err != nil {
+		return Conversation{}, err
+	}
+	if len(conversations) > 0 {
+		return conversations[0], nil
+	}
+	return s.CreateConversation("")
+}
+
+// SetActiveConversation picks the conversation a channel continues
+func (s *DBService) SetActiveConversation(channelID string, conversationID int64) error {
+	query := `INSERT INTO active_conversations (channel_id, conversation_id) VALUES (?, ?)
+	          ON CONFLICT(channel_id) DO UPDATE SET conversation_id = excluded.conversation_id`
+	_, err := s.db.Exec(query, channelID, conversationID)
+	return err
+}
+
+// ForkConversation starts a branch of the conversation holding messageID.
+// The branch keeps the messages before that one, which the caller replaces.
+func (s *DBService) ForkConversation(messageID int64) (Conversation, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer tx.Rollback()
+
+	var parentID int64
+	var title string
+	err = tx.QueryRow(`SELECT c.id, c.title FROM conversations c JOIN messages m ON m.conversation_id = c.id WHERE m.id = ?`, messageID).Scan(&parentID, &title)
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	now := time.Now()
+	result, err := tx.Exec(`INSERT INTO conversations (title, parent_id, created_at, updated_at) VALUES (?, ?, ?, ?)`, title, parentID, now.Unix(), now.Unix())
+	if err != nil {
+		return Conversation{}, err
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	result, err = tx.Exec(`INSERT INTO messages (conversation_id, user_id, user_name, role, content, tool_calls, tool_call_id, tool_name, attachments,
+	                                             discord_message_ids, provider, model, feedback, timestamp)
+	                       SELECT ?, user_id, user_name, role, content, tool_calls, tool_call_id, tool_name, attachments,
+	                              discord_message_ids, provider, model, feedback, timestamp
+	                       FROM messages WHERE conversation_id = ? AND id < ? ORDER BY id`, conversationID, parentID, messageID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	kept, err := result.RowsAffected()
+	if err != nil {
+		return Conversation{}, err
+	}
+	if _, err := tx.Exec(`UPDATE conversations SET branch_point = ? WHERE id = ?`, kept, conversationID); err != nil {
+		return Conversation{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return s.GetConversation(conversationID)
+}
+
+// Branches returns the conversations forked from the same original as
+// conversationID, that original included, oldest first
+func (s *DBService) Branches(conversationID int64) ([]Conversation, error) {
+	conversations, err := s.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	parents := map[int64]int64{}
+	for _, conversation := range conversations {
+		parents[conversation.ID] = conversation.ParentID
+	}
+	// The original is the oldest ancestor that wasn't deleted
+	root := func(id int64) int64 {
+		for range len(parents) {
+			parent := parents[id]
+			if _, ok := parents[parent]; !ok {
+				break
+			}
+			id = parent
+		}
+		return id
+	}
+
+	var branches []Conversation
+	for _, conversation := range conversations {
+		if root(conversation.ID) == root(conversationID) {
+			branches = append(branches, conversation)
+		}
+	}
+	slices.SortFunc(branches, func(a, b Conversation) int { return cmp.Compare(a.ID, b.ID) })
+	return branches, nil
+}
+
+// FindUserTurn returns the user turn saved from a Discord message, or
+// sql.ErrNoRows. Branches share the turns before their branch point, so the
+// turn in the conversation active in the channel is preferred, then the
+// newest one.
+func (s *DBService) FindUserTurn(discordID, channelID string) (UserTurn, error) {
+	var turn UserTurn
+	err := s.db.QueryRow(`SELECT id, conversation_id, content FROM messages WHERE discord_message_ids = ? AND role = 'user'
+	                      ORDER BY conversation_id = (SELECT conversation_id FROM active_conversations WHERE channel_id = ?) DESC, id DESC
+	                      LIMIT 1`, discordID, channelID).
+		Scan(&turn.ID, &turn.ConversationID, &turn.Content)
+	if err != nil {
+		return UserTurn{}, err
+	}
+
+	var replyIDs string
+	err = s.db.QueryRow(`SELECT discord_message_ids FROM messages
+	                     WHERE conversation_id = ? AND id > ? AND role = 'assistant' AND tool_calls = '' ORDER BY id LIMIT 1`,
+		turn.ConversationID, turn.ID).Scan(&replyIDs)
+	if err != nil && err != sql.ErrNoRows {
+		return UserTurn{}, err
+	}
+	if replyIDs != "" {
+		turn.ReplyDiscordIDs = strings.Split(replyIDs, ",")
+	}
+	return turn, nil
+}
+
+// ImportConversation saves a conversation brought in from an export, keeping
+// the times of its messages. Messages without a valid time, or dated before
+// the message they follow, get the time of the message before them.
+func (s *DBService) ImportConversation(userID, title string, messages []Message) (Conversation, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	createdAt := now
+	if len(messages) > 0 {
+		if t, err := time.Parse(time.RFC3339, messages[0].Time); err == nil {
+			createdAt = t.Local()
+		}
+	}
+	result, err := tx.Exec(`INSERT INTO conversations (title, created_at, updated_at) VALUES (?, ?, ?)`, title, createdAt.Unix(), now.Unix())
+	if err != nil {
+		return Conversation{}, err
+	}
+	conversationID, err := result.LastInsertId()
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	timestamp := createdAt
+	for _, msg := range messages {
+		if t, err := time.Parse(time.RFC3339, msg.Time); err == nil && !t.Before(timestamp) {
+			timestamp = t
+		}
+
+		var toolCalls, attachments []byte
+		if len(msg.ToolCalls) > 0 {
+			if toolCalls, err = json.Marshal(msg.ToolCalls); err != nil {
+				return Conversation{}, err
+			}
+		}
+		if len(msg.Attachments) > 0 {
+			if attachments, err = json.Marshal(msg.Attachments); err != nil {
+				return Conversation{}, err
+			}
+		}
+
+		_, err = tx.Exec(`INSERT INTO messages (conversation_id, user_id, user_name, role, content, tool_calls, tool_call_id, tool_name, attachments, timestamp)
+		                  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			conversationID, userID, msg.UserName, msg.Role, msg.Content, string(toolCalls), msg.ToolCallID, msg.ToolName, string(attachments), timestamp.Local())
+		if err != nil {
+			return Conversation{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return Conversation{ID: conversationID, Title: title, CreatedAt: createdAt, UpdatedAt: now, Messages: len(messages)}, nil
+}
+
+// touchConversation marks a conversation as just used
+func (s *DBService) touchConversation(id int64) error {
+	_, err := s.db.Exec(`UPDATE conversations SET updated_at = ? WHERE id = ?`, time.Now().Unix(), id)
+	return err
+}
+
 func (s *DBService) AddMessage(userID, userName, role, content string) error {
 	query := `INSERT INTO messages (user_id, user_name, role, content, timestamp) VALUES (?, ?, ?, ?, ?)`
 	_, err := s.db.Exec(query, userID, userName, role, content, time.Now())
 	return err
 }
 
-func (s *DBService) GetMessages() ([]Message, error) {
-	query := `SELECT user_name, role, content, timestamp FROM messages ORDER BY timestamp ASC`
-	rows, err := s.db.Query(query)
+// AddUserMessage saves a user turn along with a description of its attachments
+func (s *DBService) AddUserMessage(conversationID int64, userID, userName, content string, attachments []Attachment, discordID string) error {
+	var encoded []byte
+	if len(attachments) > 0 {
+		var err error
+		if encoded, err = json.Marshal(attachments); err != nil {
+			return err
+		}
+	}
+	query := `INSERT INTO messages (conversation_id, user_id, user_name, role, content, attachments, discord_message_ids, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := s.db.Exec(query, conversationID, userID, userName, RoleUser, content, string(encoded), discordID, time.Now()); err != nil {
+		return err
+	}
+	return s.touchConversation(conversationID)
+}
+
+// AddToolCallMessage saves an assistant turn that asked for tools to be run
+func (s *DBService) AddToolCallMessage(conversationID int64, userID, userName, content string, calls []ToolCall) error {
+	encoded, err := json.Marshal(calls)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO messages (conversation_id, user_id, user_name, role, content, tool_calls, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = s.db.Exec(query, conversationID, userID, userName, RoleAssistant, content, string(encoded), time.Now())
+	return err
+}
+
+// AddToolResult saves the output of a tool call
+func (s *DBService) AddToolResult(conversationID int64, userID string, call ToolCall, output string) error {
+	query := `INSERT INTO messages (conversation_id, user_id, user_name, role, content, tool_call_id, tool_name, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(query, conversationID, userID, call.Name, RoleTool, output, call.ID, call.Name, time.Now())
+	return err
+}
+
+// AddAssistantMessage saves an AI response and returns its ID
+func (s *DBService) AddAssistantMessage(conversationID int64, userID, userName, content string, target FailoverTarget) (int64, error) {
+	query := `INSERT INTO messages (conversation_id, user_id, user_name, role, content, provider, model, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(query, conversationID, userID, userName, RoleAssistant, content, target.Provider, target.Model, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return messageID, s.touchConversation(conversationID)
+}
+
+// StoredReply is what the reply buttons need to know about an assistant turn
+type StoredReply struct {
+	ConversationID int64
+	// Feedback is 1 or -1 once the reply was rated, 0 otherwise
+	Feedback int
+	// DiscordIDs are the Discord messages showing the reply
+	DiscordIDs []string
+	// Latest is set when nothing was added to the conversation after the reply
+	Latest bool
+}
+
+// GetReply returns an assistant turn by ID, or sql.ErrNoRows
+func (s *DBService) GetReply(messageID int64) (StoredReply, error) {
+	var reply StoredReply
+	var discordIDs string
+	var feedback sql.NullInt64
+	err := s.db.QueryRow(`SELECT conversation_id, discord_message_ids, feedback,
+	                      NOT EXISTS (SELECT 1 FROM messages later WHERE later.conversation_id = m.conversation_id AND later.id > m.id)
+	                      FROM messages m WHERE id = ? AND role = ?`, messageID, RoleAssistant).
+		Scan(&reply.ConversationID, &discordIDs, &feedback, &reply.Latest)
+	if err != nil {
+		return StoredReply{}, err
+	}
+	reply.Feedback = int(feedback.Int64)
+	if discordIDs != "" {
+		reply.DiscordIDs = strings.Split(discordIDs, ",")
+	}
+	return reply, nil
+}
+
+// SetReplyMessages saves which Discord messages show a reply
+func (s *DBService) SetReplyMessages(messageID int64, discordIDs []string) error {
+	_, err := s.db.Exec(`UPDATE messages SET discord_message_ids = ? WHERE id = ?`, strings.Join(discordIDs, ","), messageID)
+	return err
+}
+
+// SetFeedback saves the user's rating of a reply: 1, -1, or 0 to remove it
+func (s *DBService) SetFeedback(messageID int64, feedback int) error {
+	var value any
+	if feedback != 0 {
+		value = feedback
+	}
+	_, err := s.db.Exec(`UPDATE messages SET feedback = ? WHERE id = ?`, value, messageID)
+	return err
+}
+
+// AppendToReply adds the continuation of a cut off reply to it
+func (s *DBService) AppendToReply(messageID int64, content string) error {
+	var conversationID int64
+	err := s.db.QueryRow(`UPDATE messages SET content = content || ? WHERE id = ? RETURNING conversation_id`, content, messageID).Scan(&conversationID)
+	if err != nil {
+		return err
+	}
+	return s.touchConversation(conversationID)
+}
+
+// DeleteReply deletes an assistant turn along with the tool calls that led to
+// it. withPrompt also deletes the user turns it answered, which removes the
+// whole exchange. A summary covering the deleted turns is dropped, to be
+// written again when needed.
+func (s *DBService) DeleteReply(messageID int64, withPrompt bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var conversationID int64
+	if err := tx.QueryRow(`SELECT conversation_id FROM messages WHERE id = ?`, messageID).Scan(&conversationID); err != nil {
+		return err
+	}
+
+	// The turn starts after the last user turn, or with the prompt after the
+	// previous reply
+	start := `SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = ? AND id < ? AND role = 'user'`
+	if withPrompt {
+		start = `SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = ? AND id < ? AND role = 'assistant' AND tool_calls = ''`
+	}
+	var after int64
+	if err := tx.QueryRow(start, conversationID, messageID).Scan(&after); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = ? AND id > ? AND id <= ?`, conversationID, after, messageID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM summary WHERE conversation_id = ? AND through_id > ?`, conversationID, after); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddUsage records the usage of an AI call. messageID is the response it
+// produced, or 0 for calls without one such as summaries.
+func (s *DBService) AddUsage(messageID int64, usage UsageRecord) error {
+	var message any
+	if messageID != 0 {
+		message = messageID
+	}
+	_, err := s.db.Exec(`INSERT INTO usage (message_id, provider, model, prompt_tokens, completion_tokens, cost, latency_ms, created_at)
+	         VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		message, usage.Provider, usage.Model, usage.PromptTokens, usage.CompletionTokens,
+		usage.Cost, usage.Latency.Milliseconds(), time.Now().Unix())
+	return err
+}
+
+// GetSummary returns the running summary of a conversation, or an empty one
+// if there is none
+func (s *DBService) GetSummary(conversationID int64) (Summary, error) {
+	var summary Summary
+	err := s.db.QueryRow(`SELECT content, through_id FROM summary WHERE conversation_id = ?`, conversationID).Scan(&summary.Content, &summary.ThroughID)
+	if err == sql.ErrNoRows {
+		return Summary{}, nil
+	}
+	return summary, err
+}
+
+// SetSummary replaces the running summary of a conversation
+func (s *DBService) SetSummary(conversationID int64, content string, throughID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM summary WHERE conversation_id = ?`, conversationID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO summary (conversation_id, content, through_id, updated_at) VALUES (?, ?, ?, ?)`, conversationID, content, throughID, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUsageByDay sums usage per day (UTC, newest first) since the given time
+func (s *DBService) GetUsageByDay(since time.Time) ([]UsageTotal, error) {
+	return s.queryUsage(`date(created_at, 'unixepoch')`, `key DESC`, since)
+}
+
+// GetUsageByModel sums usage per provider and model since the given time,
+// most expensive first
+func (s *DBService) GetUsageByModel(since time.Time) ([]UsageTotal, error) {
+	return s.queryUsage(`provider || ':' || model`, `SUM(cost) DESC, requests DESC`, since)
+}
+
+// queryUsage sums the usage rows since the given time grouped by key
+func (s *DBService) queryUsage(key, order string, since time.Time) ([]UsageTotal, error) {
+	query := `SELECT ` + key + ` AS key, COUNT(*) AS requests, SUM(prompt_tokens), SUM(completion_tokens), SUM(cost), AVG(latency_ms)
+	          FROM usage WHERE created_at >= ? GROUP BY key ORDER BY ` + order
+	rows, err := s.db.Query(query, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []UsageTotal
+	for rows.Next() {
+		var total UsageTotal
+		var latencyMS float64
+		if err := rows.Scan(&total.Key, &total.Requests, &total.PromptTokens, &total.CompletionTokens, &total.Cost, &latencyMS); err != nil {
+			return nil, err
+		}
+		total.Latency = time.Duration(latencyMS) * time.Millisecond
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+// SearchMessages returns the user and assistant messages matching an FTS5
+// query, best match first. Branches share the messages before their branch
+// point, so each copied message is returned once, from the newest branch.
+func (s *DBService) SearchMessages(query string, limit int) ([]SearchResult, error) {
+	rows, err := s.db.Query(`SELECT m.id, m.conversation_id, c.title, m.role, m.user_name,
+	                                snippet(messages_fts, 0, '**', '**', '…', 24), m.timestamp
+	                         FROM messages_fts
+	                         JOIN messages m ON m.id = messages_fts.rowid
+	                         JOIN conversations c ON c.id = m.conversation_id
+	                         WHERE messages_fts MATCH ? AND m.role IN ('user', 'assistant')
+	                         ORDER BY bm25(messages_fts), m.conversation_id DESC`, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	seen := map[string]bool{}
+	for rows.Next() && len(results) < limit {
+		var result SearchResult
+		if err := rows.Scan(&result.MessageID, &result.ConversationID, &result.Title, &result.Role, &result.UserName, &result.Snippet, &result.Time); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s\x00%d\x00%s", result.Role, result.Time.UnixNano(), result.Snippet)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// ApplyRetention deletes the messages the policy no longer keeps. The rest
+// of a pruned conversation then starts at its first remaining user turn, as
+// providers expect, and its summary is dropped since it would keep the
+// pruned content. Conversations left empty are deleted.
+func (s *DBService) ApplyRetention(policy RetentionPolicy) (Pruned, error) {
+	var conditions []string
+	var args []any
+	if policy.MaxAgeDays > 0 {
+		conditions = append(conditions, `timestamp < ?`)
+		args = append(args, time.Now().AddDate(0, 0, -policy.MaxAgeDays))
+	}
+	if policy.MaxMessages > 0 {
+		conditions = append(conditions, `id NOT IN (SELECT id FROM messages ORDER BY timestamp DESC, id DESC LIMIT ?)`)
+		args = append(args, policy.MaxMessages)
+	}
+	if len(conditions) == 0 {
+		return Pruned{}, nil
+	}
+	where := strings.Join(conditions, " OR ")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Pruned{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT DISTINCT conversation_id FROM messages WHERE `+where, args...)
+	if err != nil {
+		return Pruned{}, err
+	}
+	var conversations []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return Pruned{}, err
+		}
+		conversations = append(conversations, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Pruned{}, err
+	}
+
+	var pruned Pruned
+	result, err := tx.Exec(`DELETE FROM messages WHERE `+where, args...)
+	if err != nil {
+		return Pruned{}, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return Pruned{}, err
+	}
+	pruned.Messages = int(removed)
+
+	for _, id := range conversations {
+		result, err := tx.Exec(`DELETE FROM messages WHERE conversation_id = ? AND NOT EXISTS (
+		                            SELECT 1 FROM messages turn WHERE turn.conversation_id = messages.conversation_id
+		                            AND turn.role = 'user' AND turn.id <= messages.id)`, id)
+		if err != nil {
+			return Pruned{}, err
+		}
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return Pruned{}, err
+		}
+		pruned.Messages += int(removed)
+
+		if _, err := tx.Exec(`DELETE FROM summary WHERE conversation_id = ?`, id); err != nil {
+			return Pruned{}, err
+		}
+
+		var left int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = ?`, id).Scan(&left); err != nil {
+			return Pruned{}, err
+		}
+		if left > 0 {
+			continue
+		}
+		for _, query := range []string{
+			`DELETE FROM active_conversations WHERE conversation_id = ?`,
+			`DELETE FROM conversations WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return Pruned{}, err
+			}
+		}
+		pruned.Conversations++
+	}
+
+	return pruned, tx.Commit()
+}
+
+// Vacuum compacts the search index and rebuilds the database file, giving
+// back the space of deleted rows
+func (s *DBService) Vacuum() error {
+	if _, err := s.db.Exec(`INSERT INTO messages_fts (messages_fts) VALUES ('optimize')`); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// MessageConversation returns the conversation holding a message
+func (s *DBService) MessageConversation(messageID int64) (Conversation, error) {
+	var id int64
+	if err := s.db.QueryRow(`SELECT conversation_id FROM messages WHERE id = ?`, messageID).Scan(&id); err != nil {
+		return Conversation{}, err
+	}
+	return s.GetConversation(id)
+}
+
+// GetMessages returns the messages of a conversation, oldest first
+func (s *DBService) GetMessages(conversationID int64) ([]Message, error) {
+	query := `SELECT id, user_name, role, content, tool_calls, tool_call_id, tool_name, attachments, timestamp FROM messages
+	          WHERE conversation_id = ? ORDER BY timestamp ASC, id ASC`
+	rows, err := s.db.Query(query, conversationID)
 	if err != nil {
 		return nil, err
 	}
@@ -100,10 +1065,21 @@ func (s *DBService) GetMessages() ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
+		var toolCalls, attachments string
 		var timestamp time.Time
-		if err := rows.Scan(&msg.UserName, &msg.Role, &msg.Content, &timestamp); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.UserName, &msg.Role, &msg.Content, &toolCalls, &msg.ToolCallID, &msg.ToolName, &attachments, &timestamp); err != nil {
 			return nil, err
 		}
+		if attachments != "" {
+			if err := json.Unmarshal([]byte(attachments), &msg.Attachments); err != nil {
+				return nil, fmt.Errorf("invalid attachments in history: %w", err)
+			}
+		}
+		if toolCalls != "" {
+			if err := json.Unmarshal([]byte(toolCalls), &msg.ToolCalls); err != nil {
+				return nil, fmt.Errorf("invalid tool calls in history: %w", err)
+			}
+		}
 		msg.Time = timestamp.Format(time.RFC3339)
 		messages = append(messages, msg)
 	}
@@ -115,9 +1091,17 @@ func (s *DBService) Close() {
 }
 
 func (s *DBService) ClearHistory() error {
-	query := `DELETE FROM messages`
-	_, err := s.db.Exec(query)
-	return err
+	for _, query := range []string{
+		`DELETE FROM messages`,
+		`DELETE FROM summary`,
+		`DELETE FROM active_conversations`,
+		`DELETE FROM conversations`,
+	} {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *DBService) SetUserPreference(userID, provider, model string) error {
@@ -135,3 +1119,196 @@ func (s *DBService) GetUserPreference(userID string) (provider, model string, er
 	}
 	return provider, model, err
 }
+
+func (s *DBService) SetFailoverChain(userID, chain string) error {
+	query := `INSERT INTO user_preferences (user_id, failover_chain) VALUES (?, ?)
+	         ON CONFLICT(user_id) DO UPDATE SET failover_chain = ?`
+	_, err := s.db.Exec(query, userID, chain, chain)
+	return err
+}
+
+// GetFailoverChain returns the user's failover chain, or "" when they have none
+func (s *DBService) GetFailoverChain(userID string) (string, error) {
+	var chain string
+	query := `SELECT failover_chain FROM user_preferences WHERE user_id = ?`
+	err := s.db.QueryRow(query, userID).Scan(&chain)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return chain, err
+}
+
+// CreatePersona saves a new persona. Names are unique regardless of case.
+func (s *DBService) CreatePersona(name, prompt string) (Persona, error) {
+	now := time.Now()
+	result, err := s.db.Exec(`INSERT INTO personas (name, prompt, updated_at) VALUES (?, ?, ?)`, name, prompt, now.Unix())
+	if err != nil {
+		return Persona{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Persona{}, err
+	}
+	return Persona{ID: id, Name: name, Prompt: prompt, UpdatedAt: now}, nil
+}
+
+// UpdatePersona replaces the prompt of a persona
+func (s *DBService) UpdatePersona(id int64, prompt string) error {
+	result, err := s.db.Exec(`UPDATE personas SET prompt = ?, updated_at = ? WHERE id = ?`, prompt, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// GetPersona returns the persona with a name, in any case, or sql.ErrNoRows
+func (s *DBService) GetPersona(name string) (Persona, error) {
+	personas, err := s.queryPersonas(`WHERE name = ?`, name)
+	if err != nil {
+		return Persona{}, err
+	}
+	if len(personas) == 0 {
+		return Persona{}, sql.ErrNoRows
+	}
+	return personas[0], nil
+}
+
+// GetPersonaByID returns a persona, or sql.ErrNoRows
+func (s *DBService) GetPersonaByID(id int64) (Persona, error) {
+	personas, err := s.queryPersonas(`WHERE id = ?`, id)
+	if err != nil {
+		return Persona{}, err
+	}
+	if len(personas) == 0 {
+		return Persona{}, sql.ErrNoRows
+	}
+	return personas[0], nil
+}
+
+// ListPersonas returns the user's personas by name
+func (s *DBService) ListPersonas() ([]Persona, error) {
+	return s.queryPersonas(`ORDER BY name`)
+}
+
+func (s *DBService) queryPersonas(where string, args ...any) ([]Persona, error) {
+	rows, err := s.db.Query(`SELECT id, name, prompt, updated_at FROM personas `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var personas []Persona
+	for rows.Next() {
+		var persona Persona
+		var updatedAt int64
+		if err := rows.Scan(&persona.ID, &persona.Name, &persona.Prompt, &updatedAt); err != nil {
+			return nil, err
+		}
+		persona.UpdatedAt = time.Unix(updatedAt, 0)
+		personas = append(personas, persona)
+	}
+	return personas, rows.Err()
+}
+
+// SetActivePersona picks the persona the user's requests use, 0 for the
+// default prompt
+func (s *DBService) SetActivePersona(userID string, personaID int64) error {
+	query := `INSERT INTO user_preferences (user_id, persona_id) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET persona_id = excluded.persona_id`
+	_, err := s.db.Exec(query, userID, personaID)
+	return err
+}
+
+// ActivePersona returns the persona the user picked, reporting false when
+// they use the default prompt
+func (s *DBService) ActivePersona(userID string) (Persona, bool, error) {
+	personas, err := s.queryPersonas(`WHERE id = (SELECT persona_id FROM user_preferences WHERE user_id = ?)`, userID)
+	if err != nil || len(personas) == 0 {
+		return Persona{}, false, err
+	}
+	return personas[0], true, nil
+}
+
+// SetRetention saves the user's own retention limits
+func (s *DBService) SetRetention(userID string, policy RetentionPolicy) error {
+	query := `INSERT INTO user_preferences (user_id, retention_days, retention_messages) VALUES (?, ?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET retention_days = excluded.retention_days, retention_messages = excluded.retention_messages`
+	_, err := s.db.Exec(query, userID, policy.MaxAgeDays, policy.MaxMessages)
+	return err
+}
+
+// GetRetention returns the user's own retention limits
+func (s *DBService) GetRetention(userID string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	query := `SELECT retention_days, retention_messages FROM user_preferences WHERE user_id = ?`
+	err := s.db.QueryRow(query, userID).Scan(&policy.MaxAgeDays, &policy.MaxMessages)
+	if err == sql.ErrNoRows {
+		return RetentionPolicy{}, nil
+	}
+	return policy, err
+}
+
+// SetGenerationParams saves the user's generation parameters
+func (s *DBService) SetGenerationParams(userID string, params GenerationParams) error {
+	stop := ""
+	if len(params.Stop) > 0 {
+		encoded, err := json.Marshal(params.Stop)
+		if err != nil {
+			return err
+		}
+		stop = string(encoded)
+	}
+
+	var maxTokens sql.NullInt64
+	if params.MaxTokens > 0 {
+		maxTokens = sql.NullInt64{Int64: int64(params.MaxTokens), Valid: true}
+	}
+
+	query := `INSERT INTO user_preferences (user_id, temperature, top_p, max_tokens, seed, stop_sequences, reasoning_effort)
+	         VALUES (?, ?, ?, ?, ?, ?, ?)
+	         ON CONFLICT(user_id) DO UPDATE SET temperature = excluded.temperature, top_p = excluded.top_p,
+	             max_tokens = excluded.max_tokens, seed = excluded.seed,
+	             stop_sequences = excluded.stop_sequences, reasoning_effort = excluded.reasoning_effort`
+	_, err := s.db.Exec(query, userID, params.Temperature, params.TopP, maxTokens, params.Seed, stop, params.ReasoningEffort)
+	return err
+}
+
+// GetGenerationParams returns the user's generation parameters, all unset
+// when they have none
+func (s *DBService) GetGenerationParams(userID string) (GenerationParams, error) {
+	var params GenerationParams
+	var temperature, topP sql.NullFloat64
+	var maxTokens, seed sql.NullInt64
+	var stop string
+
+	query := `SELECT temperature, top_p, max_tokens, seed, stop_sequences, reasoning_effort FROM user_preferences WHERE user_id = ?`
+	err := s.db.QueryRow(query, userID).Scan(&temperature, &topP, &maxTokens, &seed, &stop, &params.ReasoningEffort)
+	if err == sql.ErrNoRows {
+		return params, nil
+	}
+	if err != nil {
+		return params, err
+	}
+
+	if temperature.Valid {
+		params.Temperature = &temperature.Float64
+	}
+	if topP.Valid {
+		params.TopP = &topP.Float64
+	}
+	if maxTokens.Valid {
+		params.MaxTokens = int(maxTokens.Int64)
+	}
+	if seed.Valid {
+		params.Seed = &seed.Int64
+	}
+	if stop != "" {
+		if err := json.Unmarshal([]byte(stop), &params.Stop); err != nil {
+			return params, err
+		}
+	}
+	return params, nil
+}
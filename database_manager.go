@@ -11,6 +11,8 @@ type DatabaseManager struct {
 	dataDir string
 	dbs     map[string]*DBService
 	mu      sync.Mutex
+	// retention is the server-wide retention policy enforced by the janitor
+	retention RetentionPolicy
 }
 
 func NewDatabaseManager(dataDir string) (*DatabaseManager, error) {
@@ -41,6 +43,30 @@ func (m *DatabaseManager) GetUserDB(userID string) (*DBService, error) {
 	return db, nil
 }
 
+// GetThreadDB returns the database holding the history of a Discord thread,
+// which is shared by everyone taking part in it
+func (m *DatabaseManager) GetThreadDB(threadID string) (*DBService, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := "thread:" + threadID
+	if db, ok := m.dbs[key]; ok {
+		return db, nil
+	}
+
+	threadDir := filepath.Join(m.dataDir, "threads")
+	if err := os.MkdirAll(threadDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create thread directory: %w", err)
+	}
+	db, err := NewDB(filepath.Join(threadDir, fmt.Sprintf("%s.db", threadID)))
+	if err != nil {
+		return nil, fmt.Errorf("could not create new DB service for thread %s: %w", threadID, err)
+	}
+
+	m.dbs[key] = db
+	return db, nil
+}
+
 func (m *DatabaseManager) CloseAll() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	// DefaultDocumentMaxMB is the largest document downloaded, in megabytes
+	DefaultDocumentMaxMB = 10
+	// DefaultDocumentMaxTokens is how much of each document goes into the prompt
+	DefaultDocumentMaxTokens = 8000
+)
+
+// AttachmentDocument is the Attachment kind of text and PDF files
+const AttachmentDocument = "document"
+
+// Document is the text extracted from an attached file
+type Document struct {
+	Name     string
+	MIMEType string
+	Size     int
+	Text     string
+}
+
+// textTypes are the non-text/* content types read as plain text
+var textTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/sql":        true,
+}
+
+// textExtensions are read as plain text whatever type Discord reports, since
+// source files often arrive as application/octet-stream
+var textExtensions = map[string]bool{
+	".txt": true, ".log": true, ".md": true, ".csv": true, ".tsv": true,
+	".json": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".xml": true,
+	".go": true, ".py": true, ".js": true, ".ts": true, ".jsx": true, ".tsx": true,
+	".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true, ".hpp": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".lua": true,
+	".sh": true, ".bash": true, ".ps1": true, ".sql": true, ".html": true, ".css": true,
+	".diff": true, ".patch": true, ".env": true, ".conf": true, ".cfg": true,
+}
+
+// documentLimits reads DOCUMENT_MAX_MB and DOCUMENT_MAX_TOKENS
+func documentLimits() (maxBytes int64, maxTokens int) {
+	mb, err := strconv.ParseFloat(os.Getenv("DOCUMENT_MAX_MB"), 64)
+	if err != nil || mb <= 0 {
+		mb = DefaultDocumentMaxMB
+	}
+	maxTokens, err = strconv.Atoi(os.Getenv("DOCUMENT_MAX_TOKENS"))
+	if err != nil || maxTokens <= 0 {
+		maxTokens = DefaultDocumentMaxTokens
+	}
+	return int64(mb * 1024 * 1024), maxTokens
+}
+
+// readDocuments downloads the text and PDF attachments of a message and
+// extracts their text, cut to the token budget. Files that are skipped or
+// cut get a notice for the user.
+func readDocuments(ctx context.Context, attachments []discord.Attachment) ([]Document, []string) {
+	maxBytes, maxTokens := documentLimits()
+
+	var documents []Document
+	var notices []string
+	for _, attachment := range attachments {
+		mimeType, _, _ := strings.Cut(attachment.ContentType, ";")
+		if strings.HasPrefix(mimeType, "image/") {
+			continue
+		}
+
+		kind := documentKind(attachment.Filename, mimeType)
+		if kind == "" {
+			notices = append(notices, fmt.Sprintf("Skipped %s: %s files aren't supported.", attachment.Filename, describeType(attachment.Filename, mimeType)))
+			continue
+		}
+		if int64(attachment.Size) > maxBytes {
+			notices = append(notices, fmt.Sprintf("Skipped %s: it is %s and files can be at most %s.", attachment.Filename, formatBytes(int64(attachment.Size)), formatBytes(maxBytes)))
+			continue
+		}
+
+		data, err := downloadAttachment(ctx, attachment.URL, maxBytes)
+		if err != nil {
+			notices = append(notices, fmt.Sprintf("Skipped %s: could not download it (%v).", attachment.Filename, err))
+			continue
+		}
+
+		var text string
+		if kind == "pdf" {
+			text, err = extractPDFText(data)
+		} else {
+			text, err = decodeText(data)
+		}
+		if err != nil {
+			notices = append(notices, fmt.Sprintf("Skipped %s: %v.", attachment.Filename, err))
+			continue
+		}
+		if strings.TrimSpace(text) == "" {
+			notices = append(notices, fmt.Sprintf("Skipped %s: it has no text to read.", attachment.Filename))
+			continue
+		}
+
+		if estimateTokens(text) > maxTokens {
+			text = truncate(text, maxTokens*4)
+			notices = append(notices, fmt.Sprintf("%s is too long, so only its first ~%s tokens were read.", attachment.Filename, formatTokenCount(maxTokens)))
+		}
+
+		if mimeType == "" {
+			mimeType = "text/plain"
+		}
+		documents = append(documents, Document{Name: attachment.Filename, MIMEType: mimeType, Size: len(data), Text: text})
+	}
+	return documents, notices
+}
+
+// documentKind returns "pdf" or "text" for supported files and "" otherwise
+func documentKind(name, mimeType string) string {
+	switch {
+	case mimeType == "application/pdf" || strings.EqualFold(path.Ext(name), ".pdf"):
+		return "pdf"
+	case strings.HasPrefix(mimeType, "text/") || textTypes[mimeType] || textExtensions[strings.ToLower(path.Ext(name))]:
+		return "text"
+	}
+	return ""
+}
+
+// describeType names a file type for notices, e.g. ".docx"
+func describeType(name, mimeType string) string {
+	if ext := path.Ext(name); ext != "" {
+		return ext
+	}
+	if mimeType != "" {
+		return mimeType
+	}
+	return "these"
+}
+
+// decodeText checks that a file is UTF-8 text, dropping a byte order mark
+func decodeText(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("it isn't UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// extractPDFText returns the plain text of every page. The PDF parser panics
+// on some malformed files, which is reported as an error.
+func extractPDFText(data []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the PDF could not be read")
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("the PDF could not be read: %v", err)
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("the PDF text could not be extracted: %v", err)
+	}
+	extracted, err := io.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	return string(extracted), nil
+}
+
+// documentContext wraps the documents in delimiters for the prompt
+func documentContext(documents []Document) string {
+	var block strings.Builder
+	for _, document := range documents {
+		fmt.Fprintf(&block, "--- Begin file: %s ---\n%s\n--- End file: %s ---\n", document.Name, strings.TrimRight(document.Text, "\n"), document.Name)
+	}
+	return block.String()
+}
+
+// documentAttachments describes documents for the history
+func documentAttachments(documents []Document) []Attachment {
+	attachments := make([]Attachment, len(documents))
+	for i, document := range documents {
+		attachments[i] = Attachment{Kind: AttachmentDocument, Name: document.Name, MIMEType: document.MIMEType, Size: document.Size}
+	}
+	return attachments
+}
+
+// estimateTokens approximates the token count of text at four bytes a token
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
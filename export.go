@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+const (
+	// ExportFormatName identifies our JSON exports, which /import reads back
+	ExportFormatName = "kurosawa-export"
+	// ExportVersion is the version of the JSON export layout
+	ExportVersion = 1
+
+	// exportZipBytes is the size above which exports are zipped
+	exportZipBytes = 1024 * 1024
+	// maxUploadBytes is the largest file the bot can upload to Discord
+	maxUploadBytes = 10 * 1024 * 1024
+)
+
+// Export formats
+const (
+	ExportMarkdown = "markdown"
+	ExportJSON     = "json"
+	ExportHTML     = "html"
+)
+
+// exportExtensions are the file extensions of the export formats
+var exportExtensions = map[string]string{
+	ExportMarkdown: ".md",
+	ExportJSON:     ".json",
+	ExportHTML:     ".html",
+}
+
+// Export is everything exported for a user
+type Export struct {
+	Format        string               `json:"format"`
+	Version       int                  `json:"version"`
+	ExportedAt    time.Time            `json:"exported_at"`
+	UserID        string               `json:"user_id"`
+	Conversations []ExportConversation `json:"conversations"`
+}
+
+// ExportConversation is a conversation with its messages
+type ExportConversation struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Messages  []Message `json:"messages"`
+}
+
+// buildExport loads the conversations to export: the one with the given ID,
+// or all of them when id is 0
+func buildExport(db *DBService, userID string, id int64) (Export, error) {
+	export := Export{
+		Format:     ExportFormatName,
+		Version:    ExportVersion,
+		ExportedAt: time.Now().UTC(),
+		UserID:     userID,
+	}
+
+	var conversations []Conversation
+	if id != 0 {
+		conversation, err := db.GetConversation(id)
+		if err != nil {
+			return export, err
+		}
+		conversations = []Conversation{conversation}
+	} else {
+		var err error
+		if conversations, err = db.ListConversations(); err != nil {
+			return export, err
+		}
+	}
+
+	// Oldest first reads best in a transcript
+	for i := len(conversations) - 1; i >= 0; i-- {
+		conversation := conversations[i]
+		messages, err := db.GetMessages(conversation.ID)
+		if err != nil {
+			return export, err
+		}
+		export.Conversations = append(export.Conversations, ExportConversation{
+			ID:        conversation.ID,
+			Title:     conversation.Title,
+			CreatedAt: conversation.CreatedAt.UTC(),
+			UpdatedAt: conversation.UpdatedAt.UTC(),
+			Messages:  messages,
+		})
+	}
+	return export, nil
+}
+
+// renderExport renders an export in one of the export formats
+func renderExport(export Export, format string) ([]byte, error) {
+	switch format {
+	case ExportJSON:
+		return json.MarshalIndent(export, "", "  ")
+	case ExportHTML:
+		var out bytes.Buffer
+		err := exportHTMLTemplate.Execute(&out, export)
+		return out.Bytes(), err
+	case ExportMarkdown:
+		return []byte(exportMarkdown(export)), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// exportMarkdown renders an export as a Markdown transcript
+func exportMarkdown(export Export) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# Kurosawa conversations\n\nExported %s.\n", export.ExportedAt.Format("2006-01-02 15:04 MST"))
+
+	for _, conversation := range export.Conversations {
+		fmt.Fprintf(&out, "\n## %s\n\n", exportTitle(conversation))
+		fmt.Fprintf(&out, "_Started %s · %s_\n", conversation.CreatedAt.Format("2006-01-02 15:04 MST"), pluralize(len(conversation.Messages), "message"))
+
+		for _, msg := range conversation.Messages {
+			fmt.Fprintf(&out, "\n**%s** · %s\n\n", exportSpeaker(msg), exportTime(msg.Time))
+			for _, attachment := range msg.Attachments {
+				fmt.Fprintf(&out, "_Attached %s: %s_\n\n", attachment.Kind, attachment.Name)
+			}
+			switch {
+			case msg.Role == RoleTool:
+				out.WriteString("```\n" + strings.TrimRight(msg.Content, "\n") + "\n```\n")
+			case msg.Content != "":
+				out.WriteString(strings.TrimRight(msg.Content, "\n") + "\n")
+			}
+			for i, call := range msg.ToolCalls {
+				if i == 0 && msg.Content != "" {
+					out.WriteString("\n")
+				}
+				fmt.Fprintf(&out, "> 🔧 `%s(%s)`\n", call.Name, call.Arguments)
+			}
+		}
+	}
+	return out.String()
+}
+
+// exportTitle names a conversation in an export, e.g. "#3 Trip to Kyoto"
+func exportTitle(conversation ExportConversation) string {
+	if conversation.Title == "" {
+		return fmt.Sprintf("#%d Untitled conversation", conversation.ID)
+	}
+	return fmt.Sprintf("#%d %s", conversation.ID, conversation.Title)
+}
+
+// exportSpeaker names who wrote a message
+func exportSpeaker(msg Message) string {
+	switch msg.Role {
+	case RoleTool:
+		return "Tool " + msg.ToolName
+	case RoleAssistant:
+		return "Kurosawa"
+	}
+	if msg.UserName == "" {
+		return "User"
+	}
+	return msg.UserName
+}
+
+// exportTime renders an RFC 3339 message time for people
+func exportTime(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// exportHTMLTemplate renders a standalone HTML page. Message text is shown as
+// written, since it isn't always Markdown.
+var exportHTMLTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"title":   exportTitle,
+	"speaker": exportSpeaker,
+	"time":    exportTime,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Kurosawa conversations</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50rem; margin: 2rem auto; padding: 0 1rem; color: #222; background: #fafafa; }
+h2 { margin-top: 2.5rem; border-bottom: 1px solid #ddd; padding-bottom: .3rem; }
+.meta { color: #777; font-size: .85rem; }
+.message { margin: 1rem 0; padding: .75rem 1rem; border-radius: .5rem; background: #fff; border: 1px solid #e5e5e5; }
+.user { border-left: 4px solid #5865f2; }
+.assistant { border-left: 4px solid #3ba55d; }
+.tool { border-left: 4px solid #faa61a; font-size: .9rem; }
+.content { white-space: pre-wrap; word-wrap: break-word; margin-top: .4rem; }
+.tool .content, .call { font-family: ui-monospace, monospace; }
+.call, .attachment { color: #555; font-size: .85rem; margin-top: .4rem; }
+</style>
+</head>
+<body>
+<h1>Kurosawa conversations</h1>
+<p class="meta">Exported {{.ExportedAt.Format "2006-01-02 15:04 MST"}}</p>
+{{range .Conversations}}
+<h2>{{title .}}</h2>
+<p class="meta">Started {{.CreatedAt.Format "2006-01-02 15:04 MST"}}</p>
+{{range .Messages}}
+<div class="message {{.Role}}">
+<div class="meta"><strong>{{speaker .}}</strong> · {{time .Time}}</div>
+{{range .Attachments}}<div class="attachment">Attached {{.Kind}}: {{.Name}}</div>{{end}}
+{{if .Content}}<div class="content">{{.Content}}</div>{{end}}
+{{range .ToolCalls}}<div class="call">🔧 {{.Name}}({{.Arguments}})</div>{{end}}
+</div>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// packageExport names the export file and zips it when it is large
+func packageExport(data []byte, format string, exportedAt time.Time) (string, []byte, error) {
+	name := "kurosawa-export-" + exportedAt.Format("2006-01-02") + exportExtensions[format]
+	if len(data) <= exportZipBytes {
+		return name, data, nil
+	}
+
+	var out bytes.Buffer
+	archive := zip.NewWriter(&out)
+	file, err := archive.Create(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		return "", nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(name, exportExtensions[format]) + ".zip", out.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+	"github.com/diamondburned/arikawa/v3/utils/sendpart"
+)
+
+// exportCommand uploads the user's conversations as a file
+func (h *aiCommandHandler) exportCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+
+	format := data.Options.Find("format").String()
+	if format == "" {
+		format = ExportMarkdown
+	}
+	id, _ := data.Options.Find("id").IntValue()
+
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	export, err := buildExport(userDB, userID, id)
+	if err == sql.ErrNoRows {
+		return h.errorResponse(fmt.Sprintf("You have no conversation #%d. See `/chat list`.", id))
+	}
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot read your conversations: %v", err))
+	}
+	if len(export.Conversations) == 0 {
+		return h.errorResponse("You have no conversations to export.")
+	}
+
+	rendered, err := renderExport(export, format)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot export: %v", err))
+	}
+	name, file, err := packageExport(rendered, format, export.ExportedAt)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot compress the export: %v", err))
+	}
+	if len(file) > maxUploadBytes {
+		return h.errorResponse(fmt.Sprintf("The export is %s, more than Discord allows. Export one conversation at a time with the `id` option.", formatBytes(int64(len(file)))))
+	}
+
+	messages := 0
+	for _, conversation := range export.Conversations {
+		messages += len(conversation.Messages)
+	}
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(fmt.Sprintf("Here is your export: %s with %s.",
+			pluralize(len(export.Conversations), "conversation"), pluralize(messages, "message"))),
+		Files: []sendpart.File{{Name: name, Reader: bytes.NewReader(file)}},
+		Flags: discord.EphemeralMessage,
+	}
+}
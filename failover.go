@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FailoverTarget is one step of a failover chain. An empty Model means the
+// provider's default model.
+type FailoverTarget struct {
+	Provider string
+	Model    string
+}
+
+func (t FailoverTarget) String() string {
+	if t.Model == "" {
+		return t.Provider
+	}
+	return t.Provider + ":" + t.Model
+}
+
+// FailoverPolicy decides where a request goes when the user's provider fails
+type FailoverPolicy struct {
+	// Chain is the default chain for users who haven't set their own
+	Chain []FailoverTarget
+	// On lists the error kinds that move the request down the chain
+	On []error
+}
+
+// DefaultFailoverPolicy fails over on transient errors and has no default chain
+func DefaultFailoverPolicy() FailoverPolicy {
+	return FailoverPolicy{
+		On: []error{ErrRateLimited, ErrUnavailable, ErrTimeout},
+	}
+}
+
+// failoverPolicyFromEnv reads FAILOVER_CHAIN and FAILOVER_ON
+func failoverPolicyFromEnv() (FailoverPolicy, error) {
+	policy := DefaultFailoverPolicy()
+	policy.Chain = parseFailoverChain(os.Getenv("FAILOVER_CHAIN"))
+
+	if value := os.Getenv("FAILOVER_ON"); value != "" {
+		kinds, err := parseErrorKinds(value)
+		if err != nil {
+			return policy, fmt.Errorf("FAILOVER_ON: %w", err)
+		}
+		policy.On = kinds
+	}
+
+	return policy, nil
+}
+
+// parseFailoverChain parses a comma-separated chain of provider or
+// provider:model entries, e.g. "openrouter,mistral:mistral-small-latest,gemini"
+func parseFailoverChain(value string) []FailoverTarget {
+	var chain []FailoverTarget
+	for _, entry := range splitList(value) {
+		// Split on the first colon only; OpenRouter model IDs can contain one
+		provider, model, _ := strings.Cut(entry, ":")
+		chain = append(chain, FailoverTarget{
+			Provider: strings.ToLower(strings.TrimSpace(provider)),
+			Model:    strings.TrimSpace(model),
+		})
+	}
+	return chain
+}
+
+// formatFailoverChain renders a chain the way parseFailoverChain reads it
+func formatFailoverChain(chain []FailoverTarget) string {
+	entries := make([]string, len(chain))
+	for i, target := range chain {
+		entries[i] = target.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// failoverFooter notes on a reply which provider answered instead of the primary
+func failoverFooter(primary, used FailoverTarget) string {
+	return fmt.Sprintf("\n\n-# Answered by %s (%s) because %s was unavailable.", used.Provider, used.Model, primary.Provider)
+}
@@ -2,19 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
-	"google.golang.org/api/googleapi"
 	"google.golang.org/genai"
 )
 
 type GeminiProvider struct {
-	client *genai.Client
+	client       *genai.Client
+	defaultModel string
 }
 
-func NewGeminiProvider(apiKey string) (*GeminiProvider, error) {
+func NewGeminiProvider(apiKey, model string) (*GeminiProvider, error) {
+	if model == "" {
+		model = "gemini-3-pro"
+	}
 	os.Setenv("GEMINI_API_KEY", apiKey)
 	ctx := context.Background()
 	client, err := genai.NewClient(ctx, nil)
@@ -22,11 +28,120 @@ func NewGeminiProvider(apiKey string) (*GeminiProvider, error) {
 		return nil, err
 	}
 	return &GeminiProvider{
-		client: client,
+		client:       client,
+		defaultModel: model,
 	}, nil
 }
 
-func (g *GeminiProvider) GetResponse(ctx context.Context, prompt string) (string, error) {
+func (g *GeminiProvider) GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	config := g.buildConfig(req)
+	contents := g.buildContents(req)
+	model := req.modelOr(g.defaultModel)
+
+	result, err := g.client.Models.GenerateContent(
+		ctx,
+		model,
+		contents,
+		config,
+	)
+	if err != nil {
+		return ChatResponse{}, g.wrapError(err)
+	}
+
+	if err := g.blockedError(result); err != nil {
+		return ChatResponse{}, err
+	}
+
+	usage := geminiUsage(result.UsageMetadata)
+	response, calls := geminiParts(result)
+	if len(calls) > 0 {
+		return ChatResponse{Content: response, ToolCalls: calls, Usage: usage}, nil
+	}
+	if response == "" {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	return ChatResponse{Content: response, Usage: usage}, nil
+}
+
+// StreamResponse streams the completion, calling onDelta for each fragment
+func (g *GeminiProvider) StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error) {
+	var response strings.Builder
+	var usage Usage
+	var calls []ToolCall
+
+	stream := g.client.Models.GenerateContentStream(ctx, req.modelOr(g.defaultModel), g.buildContents(req), g.buildConfig(req))
+	for chunk, err := range stream {
+		if err != nil {
+			return ChatResponse{}, g.wrapError(err)
+		}
+		if err := g.blockedError(chunk); err != nil {
+			return ChatResponse{}, err
+		}
+		// Every chunk carries the running totals; the last one is final
+		if chunk.UsageMetadata != nil {
+			usage = geminiUsage(chunk.UsageMetadata)
+		}
+		delta, chunkCalls := geminiParts(chunk)
+		calls = append(calls, chunkCalls...)
+		if delta == "" {
+			continue
+		}
+		response.WriteString(delta)
+		onDelta(delta)
+	}
+
+	if len(calls) > 0 {
+		return ChatResponse{Content: response.String(), ToolCalls: calls, Usage: usage}, nil
+	}
+	if response.Len() == 0 {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	return ChatResponse{Content: response.String(), Usage: usage}, nil
+}
+
+// geminiParts returns the answer text and function calls of the first
+// candidate, skipping thoughts. Function calls keep their thought signature,
+// which Gemini 3 requires back in the next request.
+func geminiParts(resp *genai.GenerateContentResponse) (string, []ToolCall) {
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return "", nil
+	}
+
+	var text strings.Builder
+	var calls []ToolCall
+	for _, part := range resp.Candidates[0].Content.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			args, _ := json.Marshal(part.FunctionCall.Args)
+			calls = append(calls, ToolCall{
+				ID:        part.FunctionCall.ID,
+				Name:      part.FunctionCall.Name,
+				Arguments: string(args),
+				Signature: part.ThoughtSignature,
+			})
+		case part.Text != "" && !part.Thought:
+			text.WriteString(part.Text)
+		}
+	}
+	return text.String(), calls
+}
+
+// geminiUsage converts Gemini's usage metadata. Thinking tokens are billed as
+// output, so they count as completion tokens.
+func geminiUsage(metadata *genai.GenerateContentResponseUsageMetadata) Usage {
+	if metadata == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:     int(metadata.PromptTokenCount),
+		CompletionTokens: int(metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount),
+	}
+}
+
+// buildConfig builds the generation config with safety settings and the system instruction
+func (g *GeminiProvider) buildConfig(req ChatRequest) *genai.GenerateContentConfig {
 	safetySettings := []*genai.SafetySetting{
 		{
 			Category:  genai.HarmCategoryDangerousContent,
@@ -49,57 +164,197 @@ func (g *GeminiProvider) GetResponse(ctx context.Context, prompt string) (string
 	config := &genai.GenerateContentConfig{
 		SafetySettings: safetySettings,
 	}
-
-	var result *genai.GenerateContentResponse
-	const maxRetries = 5
-	baseDelay := 1 * time.Second
-	var err error
-
-	for i := 0; i < maxRetries; i++ {
-		result, err = g.client.Models.GenerateContent(
-			ctx,
-			"gemini-3-pro",
-			genai.Text(prompt),
-			config,
-		)
-		if err == nil {
-			break
+	if req.System != "" {
+		config.SystemInstruction = genai.NewContentFromText(req.System, genai.RoleUser)
+	}
+	if len(req.Tools) > 0 {
+		declarations := make([]*genai.FunctionDeclaration, len(req.Tools))
+		for i, tool := range req.Tools {
+			declarations[i] = &genai.FunctionDeclaration{
+				Name:                 tool.Name,
+				Description:          tool.Description,
+				ParametersJsonSchema: tool.Parameters,
+			}
 		}
+		config.Tools = []*genai.Tool{{FunctionDeclarations: declarations}}
+	}
+	g.applyParams(config, req)
+	return config
+}
 
-		if googleapiErr, ok := err.(*googleapi.Error); ok {
-			if googleapiErr.Code == 429 {
-				delay := baseDelay * time.Duration(1<<uint(i))
-				fmt.Printf("Rate limit exceeded (HTTP 429). Retrying in %v... (attempt %d/%d)\n", delay, i+1, maxRetries)
-				time.Sleep(delay)
-				continue
-			}
-			if googleapiErr.Code == 503 {
-				return "", fmt.Errorf("service unavailable (HTTP 503): gemini api is temporarily overloaded or down. Try again in a few moments")
-			}
-			if googleapiErr.Code == 401 || googleapiErr.Code == 403 {
-				return "", fmt.Errorf("authentication failed (HTTP %d): Invalid API key. Check your GEMINI_API_KEY in .env", googleapiErr.Code)
+// geminiThinkingBudgets maps reasoning effort to a thinking budget in tokens
+var geminiThinkingBudgets = map[string]int32{
+	ReasoningMinimal: 128,
+	ReasoningLow:     1024,
+	ReasoningMedium:  8192,
+	ReasoningHigh:    24576,
+}
+
+// applyParams copies the user's generation parameters into the config.
+// Thinking budgets are only sent to models that think.
+func (g *GeminiProvider) applyParams(config *genai.GenerateContentConfig, req ChatRequest) {
+	p := req.Params
+	if p.Temperature != nil {
+		config.Temperature = genai.Ptr(float32(*p.Temperature))
+	}
+	if p.TopP != nil {
+		config.TopP = genai.Ptr(float32(*p.TopP))
+	}
+	if p.MaxTokens > 0 {
+		config.MaxOutputTokens = int32(p.MaxTokens)
+	}
+	if p.Seed != nil {
+		config.Seed = genai.Ptr(int32(*p.Seed))
+	}
+	if len(p.Stop) > 0 {
+		// The API accepts at most 5 stop sequences
+		config.StopSequences = p.Stop[:min(len(p.Stop), 5)]
+	}
+
+	model := req.modelOr(g.defaultModel)
+	budget, ok := geminiThinkingBudgets[p.ReasoningEffort]
+	if !ok || !(strings.Contains(model, "2.5") || strings.HasPrefix(model, "gemini-3")) {
+		return
+	}
+	// Flash models can turn thinking off entirely; Pro models can't
+	if p.ReasoningEffort == ReasoningMinimal && strings.Contains(model, "flash") {
+		budget = 0
+	}
+	config.ThinkingConfig = &genai.ThinkingConfig{ThinkingBudget: genai.Ptr(budget)}
+}
+
+// wrapError converts a Gemini client error into a ProviderError
+func (g *GeminiProvider) wrapError(err error) error {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return newTransportError(g.GetName(), err)
+	}
+
+	providerErr := &ProviderError{
+		Kind:       classifyStatus(apiErr.Code, apiErr.Message),
+		Provider:   g.GetName(),
+		StatusCode: apiErr.Code,
+		RetryAfter: geminiRetryDelay(apiErr.Details),
+		Message:    apiErr.Message,
+	}
+	// Gemini reports an invalid API key as 400 INVALID_ARGUMENT
+	if strings.Contains(apiErr.Message, "API key not valid") {
+		providerErr.Kind = ErrAuth
+	}
+	if providerErr.Kind == ErrAuth {
+		providerErr.Message += " (check GEMINI_API_KEY in .env)"
+	}
+	return providerErr
+}
+
+// geminiRetryDelay reads the retry delay Gemini attaches to quota errors
+func geminiRetryDelay(details []map[string]any) time.Duration {
+	for _, detail := range details {
+		if delay, ok := detail["retryDelay"].(string); ok {
+			if d, err := time.ParseDuration(delay); err == nil {
+				return d
 			}
 		}
+	}
+	return 0
+}
 
-		return "", fmt.Errorf("failed to call gemini api: %v", err)
+// blockedError reports a prompt or response stopped by Gemini's safety filters
+func (g *GeminiProvider) blockedError(resp *genai.GenerateContentResponse) error {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		return &ProviderError{Kind: ErrContentBlocked, Provider: g.GetName(), Message: "prompt blocked: " + string(resp.PromptFeedback.BlockReason)}
 	}
 
-	if err != nil {
-		return "", fmt.Errorf("failed to call gemini api after %d retries: %v. Free tier models may have capacity limits during high demand. Try again later or use a different model", maxRetries, err)
+	for _, candidate := range resp.Candidates {
+		switch candidate.FinishReason {
+		case genai.FinishReasonSafety, genai.FinishReasonProhibitedContent, genai.FinishReasonBlocklist, genai.FinishReasonSPII:
+			return &ProviderError{Kind: ErrContentBlocked, Provider: g.GetName(), Message: "response blocked: " + string(candidate.FinishReason)}
+		}
 	}
+	return nil
+}
 
-	response := result.Text()
-	if response == "" {
-		return "Sorry, I cannot respond to this.", nil
+// buildContents maps the conversation turns to Gemini contents. Tool results
+// are function responses in a user turn; consecutive results share one turn.
+func (g *GeminiProvider) buildContents(req ChatRequest) []*genai.Content {
+	contents := make([]*genai.Content, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case RoleTool:
+			part := &genai.Part{FunctionResponse: &genai.FunctionResponse{
+				ID:       msg.ToolCallID,
+				Name:     msg.ToolName,
+				Response: map[string]any{"output": msg.Content},
+			}}
+			if last := len(contents) - 1; last >= 0 && contents[last].Parts[0].FunctionResponse != nil {
+				contents[last].Parts = append(contents[last].Parts, part)
+			} else {
+				contents = append(contents, &genai.Content{Role: genai.RoleUser, Parts: []*genai.Part{part}})
+			}
+		case RoleAssistant:
+			content := &genai.Content{Role: genai.RoleModel}
+			if msg.Content != "" {
+				content.Parts = append(content.Parts, genai.NewPartFromText(msg.Content))
+			}
+			for _, call := range msg.ToolCalls {
+				var args map[string]any
+				_ = json.Unmarshal([]byte(call.Arguments), &args)
+				content.Parts = append(content.Parts, &genai.Part{
+					FunctionCall:     &genai.FunctionCall{ID: call.ID, Name: call.Name, Args: args},
+					ThoughtSignature: call.Signature,
+				})
+			}
+			if len(content.Parts) == 0 {
+				content.Parts = []*genai.Part{genai.NewPartFromText("")}
+			}
+			contents = append(contents, content)
+		default:
+			parts := []*genai.Part{genai.NewPartFromText(msg.Content)}
+			for _, image := range msg.Images {
+				parts = append(parts, genai.NewPartFromBytes(image.Data, image.MIMEType))
+			}
+			contents = append(contents, genai.NewContentFromParts(parts, genai.RoleUser))
+		}
 	}
+	return contents
+}
+
+// SupportsVision reports that Gemini models accept images
+func (g *GeminiProvider) SupportsVision(model string) bool {
+	return true
+}
 
-	return response, nil
+// SupportsTools reports that Gemini models can call tools
+func (g *GeminiProvider) SupportsTools() bool {
+	return true
 }
 
 func (g *GeminiProvider) GetName() string {
 	return "Gemini"
 }
 
+// ListModels fetches the models that support content generation
+func (g *GeminiProvider) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var models []ModelInfo
+	for model, err := range g.client.Models.All(ctx) {
+		if err != nil {
+			return nil, g.wrapError(err)
+		}
+		if !slices.Contains(model.SupportedActions, "generateContent") {
+			continue
+		}
+		models = append(models, ModelInfo{
+			ID:            strings.TrimPrefix(model.Name, "models/"),
+			ContextLength: int(model.InputTokenLimit),
+		})
+	}
+	return models, nil
+}
+
+func (g *GeminiProvider) GetDefaultModel() string {
+	return g.defaultModel
+}
+
 func (g *GeminiProvider) GetAvailableModels() []string {
 	return []string{
 		"gemini-3-pro",
@@ -6,6 +6,8 @@ require (
 	github.com/PuerkitoBio/goquery v1.10.3
 	github.com/diamondburned/arikawa/v3 v3.6.0
 	github.com/joho/godotenv v1.5.1
+	github.com/ledongthuc/pdf v0.0.0-20250511090121-5959a4027728
+	github.com/openai/openai-go v1.12.0
 	google.golang.org/api v0.249.0
 	google.golang.org/genai v1.23.0
 	modernc.org/sqlite v1.38.2
@@ -29,7 +31,6 @@ require (
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
-	github.com/openai/openai-go v1.12.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
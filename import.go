@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxImportBytes is the largest import file accepted, once unzipped
+const maxImportBytes = 50 * 1024 * 1024
+
+// ChatGPTName is the speaker name given to ChatGPT's imported replies
+const ChatGPTName = "ChatGPT"
+
+// ImportedConversation is a conversation read from an export file
+type ImportedConversation struct {
+	Title    string
+	Messages []Message
+}
+
+// Import is what was read from an export file
+type Import struct {
+	// Source names where the file came from, e.g. "ChatGPT"
+	Source        string
+	Conversations []ImportedConversation
+	// Skipped counts the messages that could not be imported, such as images
+	// or tool output in ChatGPT exports
+	Skipped int
+}
+
+// parseImport reads one of our JSON exports or ChatGPT's conversations.json,
+// either as is or zipped. userName is the speaker name given to the user's
+// messages in ChatGPT exports, which don't record it.
+func parseImport(data []byte, userName string) (Import, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		var err error
+		if data, err = unzipImport(data); err != nil {
+			return Import{}, err
+		}
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return Import{}, errors.New("the file is empty")
+	}
+	switch data[0] {
+	case '{':
+		return parseKurosawaExport(data)
+	case '[':
+		return parseChatGPTExport(data, userName)
+	}
+	return Import{}, errors.New("the file is not JSON. Upload a `/export` JSON file or ChatGPT's `conversations.json`")
+}
+
+// unzipImport finds the export in a zip file: ChatGPT's conversations.json, or
+// the only JSON file in it
+func unzipImport(data []byte) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the zip file: %w", err)
+	}
+
+	var found *zip.File
+	jsonFiles := 0
+	for _, file := range archive.File {
+		if path.Base(file.Name) == "conversations.json" {
+			found = file
+			break
+		}
+		if strings.EqualFold(path.Ext(file.Name), ".json") {
+			jsonFiles++
+			found = file
+		}
+	}
+	if found == nil || (jsonFiles > 1 && path.Base(found.Name) != "conversations.json") {
+		return nil, errors.New("the zip file should contain `conversations.json` or a single JSON file")
+	}
+
+	file, err := found.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", found.Name, err)
+	}
+	defer file.Close()
+
+	data, err = io.ReadAll(io.LimitReader(file, maxImportBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", found.Name, err)
+	}
+	if len(data) > maxImportBytes {
+		return nil, fmt.Errorf("%s is larger than %s", found.Name, formatBytes(maxImportBytes))
+	}
+	return data, nil
+}
+
+// parseKurosawaExport reads a JSON file written by /export
+func parseKurosawaExport(data []byte) (Import, error) {
+	var export Export
+	if err := json.Unmarshal(data, &export); err != nil {
+		return Import{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if export.Format != ExportFormatName {
+		return Import{}, errors.New("this JSON file is not a `/export` file or a ChatGPT export")
+	}
+	if export.Version > ExportVersion {
+		return Import{}, fmt.Errorf("the export is version %d, but this bot only reads up to version %d", export.Version, ExportVersion)
+	}
+
+	imported := Import{Source: "Kurosawa"}
+	for i, conversation := range export.Conversations {
+		if err := validateMessages(conversation.Messages); err != nil {
+			return Import{}, fmt.Errorf("conversation %d (%q): %w", i+1, conversation.Title, err)
+		}
+		messages := slices.Clone(conversation.Messages)
+		for j := range messages {
+			messages[j].ID = 0
+		}
+		imported.Conversations = append(imported.Conversations, ImportedConversation{
+			Title:    truncate(conversation.Title, maxConversationTitle),
+			Messages: messages,
+		})
+	}
+	return imported, nil
+}
+
+// validateMessages checks that imported messages can be sent back to a
+// provider: known roles, and tool results that answer an earlier tool call
+func validateMessages(messages []Message) error {
+	calls := map[string]bool{}
+	for i, msg := range messages {
+		switch msg.Role {
+		case RoleUser:
+		case RoleAssistant:
+			for _, call := range msg.ToolCalls {
+				if call.ID == "" || call.Name == "" {
+					return fmt.Errorf("message %d has a tool call without an ID or name", i+1)
+				}
+				calls[call.ID] = true
+			}
+		case RoleTool:
+			if !calls[msg.ToolCallID] {
+				return fmt.Errorf("message %d is the result of an unknown tool call", i+1)
+			}
+		default:
+			return fmt.Errorf("message %d has unknown role %q", i+1, msg.Role)
+		}
+		if msg.Time != "" {
+			if _, err := time.Parse(time.RFC3339, msg.Time); err != nil {
+				return fmt.Errorf("message %d has invalid time %q", i+1, msg.Time)
+			}
+		}
+	}
+	return nil
+}
+
+// chatGPTConversation is a conversation in ChatGPT's conversations.json. Its
+// messages form a tree, since editing a message starts a new branch; the
+// branch shown last ends at CurrentNode.
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string          `json:"parent"`
+	Message *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+		Text        string            `json:"text"`
+	} `json:"content"`
+	Metadata struct {
+		Hidden bool `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// parseChatGPTExport reads ChatGPT's conversations.json. Only the text of the
+// last branch of each conversation is imported.
+func parseChatGPTExport(data []byte, userName string) (Import, error) {
+	var conversations []chatGPTConversation
+	if err := json.Unmarshal(data, &conversations); err != nil {
+		return Import{}, fmt.Errorf("invalid ChatGPT export: %w", err)
+	}
+
+	imported := Import{Source: ChatGPTName}
+	for i, conversation := range conversations {
+		if conversation.Mapping == nil {
+			return Import{}, fmt.Errorf("conversation %d has no messages mapping; is this ChatGPT's conversations.json?", i+1)
+		}
+
+		var messages []Message
+		for _, msg := range chatGPTBranch(conversation) {
+			if msg.Metadata.Hidden {
+				continue
+			}
+			role := msg.Author.Role
+			text, ok := chatGPTText(msg)
+			if !ok || text == "" || (role != RoleUser && role != RoleAssistant) {
+				// System prompts and empty placeholders aren't worth a mention
+				if role != "system" && !chatGPTEmpty(msg) {
+					imported.Skipped++
+				}
+				continue
+			}
+
+			name := userName
+			if role == RoleAssistant {
+				name = ChatGPTName
+			}
+			timestamp := ""
+			if t := chatGPTTime(msg.CreateTime, conversation.CreateTime); !t.IsZero() {
+				timestamp = t.Format(time.RFC3339)
+			}
+
+			// Replies split by tool use become one turn again
+			if last := len(messages) - 1; last >= 0 && messages[last].Role == role {
+				messages[last].Content += "\n\n" + text
+				continue
+			}
+			messages = append(messages, Message{Role: role, Content: text, Time: timestamp, UserName: name})
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		title := conversationTitle(conversation.Title)
+		if title == "" {
+			title = conversationTitle(messages[0].Content)
+		}
+		imported.Conversations = append(imported.Conversations, ImportedConversation{Title: title, Messages: messages})
+	}
+	return imported, nil
+}
+
+// chatGPTBranch returns the messages from the root of a conversation to its
+// current node
+func chatGPTBranch(conversation chatGPTConversation) []*chatGPTMessage {
+	var branch []*chatGPTMessage
+	seen := map[string]bool{}
+	for id := conversation.CurrentNode; id != "" && !seen[id]; {
+		seen[id] = true
+		node, ok := conversation.Mapping[id]
+		if !ok {
+			break
+		}
+		if node.Message != nil {
+			branch = append(branch, node.Message)
+		}
+		id = node.Parent
+	}
+	slices.Reverse(branch)
+	return branch
+}
+
+// chatGPTText joins the text parts of a message. It reports false for
+// messages that aren't text, such as code run by a tool or generated images.
+func chatGPTText(msg *chatGPTMessage) (string, bool) {
+	switch msg.Content.ContentType {
+	case "text", "multimodal_text":
+		return strings.TrimSpace(strings.Join(chatGPTStrings(msg.Content.Parts), "\n")), true
+	}
+	return "", false
+}
+
+// chatGPTEmpty reports whether a message has no content at all
+func chatGPTEmpty(msg *chatGPTMessage) bool {
+	for _, part := range msg.Content.Parts {
+		if string(bytes.TrimSpace(part)) != `""` {
+			return false
+		}
+	}
+	return strings.TrimSpace(msg.Content.Text) == ""
+}
+
+// chatGPTStrings returns the parts that are strings, leaving out attached
+// images and other files
+func chatGPTStrings(parts []json.RawMessage) []string {
+	var texts []string
+	for _, part := range parts {
+		var text string
+		if json.Unmarshal(part, &text) == nil && strings.TrimSpace(text) != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// chatGPTTime converts a ChatGPT timestamp in seconds, falling back to the
+// conversation's when the message has none
+func chatGPTTime(seconds, fallback float64) time.Time {
+	if seconds <= 0 {
+		seconds = fallback
+	}
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC()
+}
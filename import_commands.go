@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// importCommand adds the conversations of an uploaded export to the user's history
+func (h *aiCommandHandler) importCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	sender := data.Event.Sender()
+	userID := sender.ID.String()
+
+	fileID, err := data.Options.Find("file").SnowflakeValue()
+	if err != nil {
+		return h.errorResponse("Attach the file to import.")
+	}
+	attachment, ok := data.Data.Resolved.Attachments[discord.AttachmentID(fileID)]
+	if !ok {
+		return h.errorResponse("Cannot find the attached file.")
+	}
+	if attachment.Size > maxImportBytes {
+		return h.errorResponse(fmt.Sprintf("The file is %s; imports are limited to %s.",
+			formatBytes(int64(attachment.Size)), formatBytes(maxImportBytes)))
+	}
+
+	file, err := downloadAttachment(ctx, attachment.URL, maxImportBytes)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot download %s: %v", attachment.Filename, err))
+	}
+	imported, err := parseImport(file, sender.Username)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot import %s: %v", attachment.Filename, err))
+	}
+
+	// Oldest first, so that the newest gets the highest number in /chat list
+	conversations := imported.Conversations
+	slices.SortStableFunc(conversations, func(a, b ImportedConversation) int {
+		return importStart(a).Compare(importStart(b))
+	})
+	if title := strings.TrimSpace(data.Options.Find("title").String()); title != "" {
+		conversations = []ImportedConversation{mergeImported(conversations, title)}
+	}
+
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	var saved []Conversation
+	turns := 0
+	for _, conversation := range conversations {
+		if len(conversation.Messages) == 0 {
+			continue
+		}
+		result, err := userDB.ImportConversation(userID, conversation.Title, conversation.Messages)
+		if err != nil {
+			return h.errorResponse(fmt.Sprintf("Imported %s before failing: %v",
+				pluralize(len(saved), "conversation"), err))
+		}
+		saved = append(saved, result)
+		turns += result.Messages
+	}
+	if len(saved) == 0 {
+		return h.errorResponse(fmt.Sprintf("%s has no messages to import.", attachment.Filename))
+	}
+
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "Imported %s with %s from %s.", pluralize(len(saved), "conversation"),
+		pluralize(turns, "turn"), imported.Source)
+	if imported.Skipped > 0 {
+		fmt.Fprintf(&reply, " Skipped %s that weren't text, such as images or tool output.",
+			pluralize(imported.Skipped, "message"))
+	}
+	if len(saved) == 1 {
+		fmt.Fprintf(&reply, "\nContinue it with `/chat switch id:%d`.", saved[0].ID)
+	} else {
+		reply.WriteString("\nSee them with `/chat list` and continue one with `/chat switch`.")
+	}
+
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(reply.String()),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// mergeImported joins imported conversations into one with the given title
+func mergeImported(conversations []ImportedConversation, title string) ImportedConversation {
+	merged := ImportedConversation{Title: truncate(title, maxConversationTitle)}
+	for _, conversation := range conversations {
+		merged.Messages = append(merged.Messages, conversation.Messages...)
+	}
+	return merged
+}
+
+// importStart returns the time of the first message of an imported
+// conversation, or the zero time when it is unknown
+func importStart(conversation ImportedConversation) time.Time {
+	if len(conversation.Messages) == 0 {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, conversation.Messages[0].Time)
+	return t
+}
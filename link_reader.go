@@ -1,13 +1,84 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+const (
+	// pageTimeout bounds a page fetched for a tool, redirects included
+	pageTimeout = 15 * time.Second
+	// maxPageBytes is how much of a page is read for a tool
+	maxPageBytes = 2 << 20
+)
+
+var errPrivateAddress = errors.New("the address is private or local")
+
+// pageClient fetches pages for the models. It only connects to public
+// addresses, checked when dialing so that redirects and DNS answers can't
+// point it at the bot's own host or network.
+var pageClient = &http.Client{
+	Timeout: pageTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: pageTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("cannot connect to %s: %w", host, errPrivateAddress)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   pageTimeout,
+		ResponseHeaderTimeout: pageTimeout,
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether an address is reachable on the internet rather
+// than loopback, private, link-local or otherwise reserved
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// ReadPage returns the paragraph text of a page like GetContentFromURL, but
+// it stops with ctx, reads at most maxPageBytes and refuses private and
+// loopback destinations
+func ReadPage(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := pageClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
+	}
+	return pageText(io.LimitReader(res.Body, maxPageBytes))
+}
+
 func GetContentFromURL(url string) (string, error) {
 	res, err := http.Get(url)
 	if err != nil {
@@ -19,7 +90,12 @@ func GetContentFromURL(url string) (string, error) {
 		return "", fmt.Errorf("status code error: %d %s", res.StatusCode, res.Status)
 	}
 
-	doc, err := goquery.NewDocumentFromReader(res.Body)
+	return pageText(res.Body)
+}
+
+// pageText extracts the paragraphs of an HTML page
+func pageText(r io.Reader) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
 		return "", err
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"log"
 	"os"
 	"regexp"
@@ -55,42 +56,76 @@ func main() {
 	}
 	defer dbManager.CloseAll()
 
+	retention, err := retentionConfigFromEnv()
+	if err != nil {
+		log.Fatal("Invalid retention configuration:", err)
+	}
+	dbManager.StartJanitor(retention)
+
 	providerFactory, err := NewProviderFactory()
 	if err != nil {
 		log.Fatal("Cannot initialize provider factory:", err)
 	}
 
-	mlService, err = NewMLService(dbManager, providerFactory.GetProviders())
+	failover, err := failoverPolicyFromEnv()
 	if err != nil {
-		log.Fatal("Cannot initialize ML service:", err)
+		log.Fatal("Invalid failover configuration:", err)
+	}
+
+	quotas, err := quotaServiceFromEnv("user_data")
+	if err != nil {
+		log.Fatal("Cannot initialize quotas:", err)
 	}
+	defer quotas.Close()
 
 	bot := state.New("Bot " + token)
 	bot.AddIntents(gateway.IntentGuildMessages | gateway.IntentMessageContent | gateway.IntentGuilds)
 
+	tools, err := toolRegistryFromEnv(bot)
+	if err != nil {
+		log.Fatal("Invalid tool configuration:", err)
+	}
+
+	contextPolicy, err := contextPolicyFromEnv()
+	if err != nil {
+		log.Fatal("Invalid context configuration:", err)
+	}
+
+	catalogTTL, err := modelCatalogTTLFromEnv()
+	if err != nil {
+		log.Fatal("Invalid model catalog configuration:", err)
+	}
+	mlService, err = NewMLService(dbManager, providerFactory.GetProviders(), NewModelCatalog(catalogTTL), failover, quotas, tools, contextPolicy)
+	if err != nil {
+		log.Fatal("Cannot initialize ML service:", err)
+	}
+
 	bot.AddHandler(func(m *gateway.MessageCreateEvent) {
 		if m.Author.Bot {
 			return
 		}
+		if thread, isAIChannel, ok := aiMessage(bot, &m.Message); ok {
+			handleAIMessage(bot, m, isAIChannel, thread)
+		}
+	})
 
-		ch, err := bot.Channel(m.ChannelID)
-		if err != nil {
-			log.Printf("Error getting channel: %v", err)
+	bot.AddHandler(func(m *gateway.MessageUpdateEvent) {
+		if m.Author.Bot {
 			return
 		}
-
-		//nolint:SA4006
-		isAIChannel := strings.HasPrefix(ch.Name, "ai-")
-
-		if isAIChannel || (m.ChannelID == channelID && strings.HasPrefix(m.Content, "!m ")) {
-			handleAIMessage(bot, m, isAIChannel)
+		if thread, isAIChannel, ok := aiMessage(bot, &m.Message); ok {
+			handleEditedMessage(bot, m, isAIChannel, thread)
 		}
 	})
 
+	bot.AddHandler(func(e *gateway.ThreadCreateEvent) {
+		joinAIThread(bot, e)
+	})
+
 	bot.AddInteractionHandler(&InteractionHandler{bot: bot})
 
 	router := cmdroute.NewRouter()
-	RegisterCommands(router, bot, dbManager)
+	RegisterCommands(router, bot, dbManager, quotas)
 	bot.AddInteractionHandler(router)
 
 	if err := bot.Open(context.Background()); err != nil {
@@ -132,30 +167,193 @@ type InteractionHandler struct {
 func (h *InteractionHandler) HandleInteraction(e *discord.InteractionEvent) *api.InteractionResponse {
 	switch data := e.Data.(type) {
 	case *discord.ButtonInteraction:
+		if action, ref, ok := parseReplyButton(data.CustomID); ok {
+			return handleReplyButton(h.bot, e, action, ref)
+		}
 		switch data.CustomID {
 		case "create_ticket":
 			createTicketChannel(h.bot, e)
 		case "close_ticket":
 			closeTicketChannel(h.bot, e)
 		}
+	case *discord.StringSelectInteraction:
+		if action, ok := parseSearchMenu(data.CustomID); ok {
+			return handleSearchMenu(e, action, data.Values)
+		}
+	case *discord.ModalInteraction:
+		if action, persona, ok := parsePersonaModal(data.CustomID); ok {
+			return handlePersonaModal(e, data, action, persona)
+		}
 	}
 	return nil
 }
 
-func handleAIMessage(bot *state.State, m *gateway.MessageCreateEvent, isPrivate bool) {
-	var message string
-	if isPrivate {
-		message = m.Content
-	} else {
-		message = strings.TrimPrefix(m.Content, "!m ")
+// aiMessage reports whether the bot answers a message: every message in an
+// AI channel, and those starting with "!m " in the main channel. thread is
+// set for messages in a thread, which has a history of its own.
+func aiMessage(bot *state.State, m *discord.Message) (thread *discord.Channel, isAIChannel, ok bool) {
+	ch, err := bot.Channel(m.ChannelID)
+	if err != nil {
+		log.Printf("Error getting channel: %v", err)
+		return nil, false, false
+	}
+
+	// Messages in a thread follow the rules of the channel it belongs
+	// to, except that threads started with /thread take every message
+	if isThread(ch) {
+		thread = ch
+		if ch, err = bot.Channel(thread.ParentID); err != nil {
+			log.Printf("Error getting thread parent: %v", err)
+			return nil, false, false
+		}
+	}
+
+	//nolint:SA4006
+	isAIChannel = isAIChannelName(ch.Name)
+	if thread != nil {
+		if me, err := bot.Me(); err == nil && thread.OwnerID == me.ID {
+			isAIChannel = true
+		}
+	}
+
+	ok = isAIChannel || (ch.ID == channelID && strings.HasPrefix(m.Content, "!m "))
+	return thread, isAIChannel, ok
+}
+
+// aiMessageText is the text of a message for the AI, without the "!m "
+// prefix used outside AI channels
+func aiMessageText(content string, isPrivate bool) string {
+	if !isPrivate {
+		content = strings.TrimPrefix(content, "!m ")
 	}
-	message = strings.TrimSpace(message)
+	return strings.TrimSpace(content)
+}
 
-	if message == "" {
+// handleAIMessage answers a message in an AI channel. thread is set for
+// messages in a thread, which has a history of its own.
+func handleAIMessage(bot *state.State, m *gateway.MessageCreateEvent, isPrivate bool, thread *discord.Channel) {
+	user := aiUser(m)
+	input, ok := aiInput(bot, m, isPrivate, thread)
+	if !ok {
+		return
+	}
+	if thread != nil {
+		user.ThreadID = thread.ID.String()
+	}
+
+	if mlService.SupportsStreaming(user.ID) {
+		streamAIResponse(bot, m.ChannelID, user, input, nil)
 		return
 	}
 
+	reply, err := mlService.GetResponse(user, input)
+	if err != nil {
+		log.Printf("Error getting AI response: %v", err)
+		bot.SendMessage(m.ChannelID, UserFacingError(err))
+		return
+	}
+
+	messages, err := sendLongMessage(bot, m.ChannelID, reply.Text, replyButtons(newReplyRef(user, reply.MessageID), 0))
+	if err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+	saveReplyMessages(user, reply.MessageID, messages)
+}
+
+// handleEditedMessage answers an edited message again. The conversation
+// forks into a branch at the edited turn, and the old reply is rewritten in
+// place; the old turns stay in the conversation, see /branches.
+func handleEditedMessage(bot *state.State, m *gateway.MessageUpdateEvent, isPrivate bool, thread *discord.Channel) {
+	event := &gateway.MessageCreateEvent{Message: m.Message, Member: m.Member}
+	user := aiUser(event)
+	if thread != nil {
+		user.ThreadID = thread.ID.String()
+	}
+
+	db, err := mlService.HistoryDB(user)
+	if err != nil {
+		log.Printf("Error getting history: %v", err)
+		return
+	}
+	turn, err := db.FindUserTurn(m.ID.String(), user.ChannelID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error finding edited message: %v", err)
+		}
+		return
+	}
+
+	// Discord also reports updates such as link previews, which leave the
+	// text as it was. Saved turns end with the text, after any files and
+	// web pages read into them.
+	text := aiMessageText(m.Content, isPrivate)
+	if text == "" || strings.HasSuffix(turn.Content, text) {
+		return
+	}
+
+	input, ok := aiInput(bot, event, isPrivate, thread)
+	if !ok {
+		return
+	}
+	input.Edits = turn.ID
+
+	var old []discord.MessageID
+	for _, id := range turn.ReplyDiscordIDs {
+		if snowflake, err := discord.ParseSnowflake(id); err == nil {
+			old = append(old, discord.MessageID(snowflake))
+		}
+	}
+	streamAIResponse(bot, m.ChannelID, user, input, old)
+}
+
+// aiUser describes the author of a message for the ML service
+func aiUser(m *gateway.MessageCreateEvent) ChatUser {
+	userName := m.Author.Username
+	if m.Member != nil && m.Member.Nick != "" {
+		userName = m.Member.Nick
+	}
+
+	user := ChatUser{ID: m.Author.ID.String(), Name: userName, ChannelID: m.ChannelID.String()}
+	if m.GuildID.IsValid() {
+		user.GuildID = m.GuildID.String()
+	}
+	if m.Member != nil {
+		for _, roleID := range m.Member.RoleIDs {
+			user.RoleIDs = append(user.RoleIDs, roleID.String())
+		}
+	}
+	return user
+}
+
+// aiInput reads a message for the AI: its text, with the attached files and
+// linked pages, and its images. It reports false when there is nothing to
+// answer or an attachment can't be used.
+func aiInput(bot *state.State, m *gateway.MessageCreateEvent, isPrivate bool, thread *discord.Channel) (ChatInput, bool) {
+	message := aiMessageText(m.Content, isPrivate)
+
+	images, err := downloadImages(context.Background(), m.Attachments)
+	if err != nil {
+		bot.SendMessage(m.ChannelID, "Cannot use the attachment: "+err.Error())
+		return ChatInput{}, false
+	}
+
+	// Links are only followed in the user's own text, never inside the
+	// attached files
 	urls := findURLs(message)
+
+	// Text files and PDFs are read into the message like web pages below
+	documents, notices := readDocuments(context.Background(), m.Attachments)
+	if len(notices) > 0 {
+		bot.SendMessage(m.ChannelID, "-# "+strings.Join(notices, "\n-# "))
+	}
+	if len(documents) > 0 {
+		message = documentContext(documents) + "\n" + message
+	}
+
+	if message == "" && len(images) == 0 {
+		return ChatInput{}, false
+	}
+
 	if len(urls) > 0 {
 		for _, url := range urls {
 			content, err := GetContentFromURL(url)
@@ -167,22 +365,43 @@ func handleAIMessage(bot *state.State, m *gateway.MessageCreateEvent, isPrivate
 		}
 	}
 
-	userName := m.Author.Username
-	if m.Member != nil && m.Member.Nick != "" {
-		userName = m.Member.Nick
+	input := ChatInput{Text: message, Images: images, Documents: documentAttachments(documents), MessageID: m.ID.String()}
+	if thread != nil {
+		input.Starter = func() *ThreadStarter { return threadStarter(bot, thread) }
+	}
+	return input, true
+}
+
+// streamAIResponse shows the AI response progressively while it is generated.
+// reuse holds the messages of an earlier reply to write it into, if any;
+// otherwise a new message is posted.
+func streamAIResponse(bot *state.State, channelID discord.ChannelID, user ChatUser, input ChatInput, reuse []discord.MessageID) {
+	renderer := newStreamRenderer(bot, channelID)
+	if len(reuse) > 0 {
+		renderer.Reuse(reuse)
+	} else if err := renderer.Start(); err != nil {
+		log.Printf("Error sending placeholder message: %v", err)
+		return
 	}
 
-	response, err := mlService.GetResponse(m.Author.ID.String(), userName, message)
+	// Earlier replies are also rewritten for providers that don't stream
+	var onDelta func(string)
+	if mlService.SupportsStreaming(user.ID) {
+		onDelta = renderer.Write
+	}
+	reply, err := mlService.StreamResponse(user, input, onDelta)
 	if err != nil {
 		log.Printf("Error getting AI response: %v", err)
-		bot.SendMessage(m.ChannelID, "An error occurred while contacting the AI.")
+		if err := renderer.Fail(UserFacingError(err), nil); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
 		return
 	}
 
-	err = sendLongMessage(bot, m.ChannelID, response)
-	if err != nil {
+	if err := renderer.Finish(reply.Text, replyButtons(newReplyRef(user, reply.MessageID), 0)); err != nil {
 		log.Printf("Error sending message: %v", err)
 	}
+	saveReplyMessages(user, reply.MessageID, renderer.Messages())
 }
 
 func findURLs(text string) []string {
@@ -190,27 +409,28 @@ func findURLs(text string) []string {
 	return r.FindAllString(text, -1)
 }
 
-func sendLongMessage(bot *state.State, channelID discord.ChannelID, message string) error {
-	if len(message) <= MaxMessageLength {
-		_, err := bot.SendMessage(channelID, message)
-		return err
-	}
-
+// sendLongMessage sends a message split into parts Discord accepts, with
+// components attached to the last part, and returns the messages sent
+func sendLongMessage(bot *state.State, channelID discord.ChannelID, message string, components discord.ContainerComponents) ([]discord.MessageID, error) {
 	parts := splitMessage(message, MaxMessageLength)
 
+	var sent []discord.MessageID
 	for i, part := range parts {
-		messageToSend := part
+		data := api.SendMessageData{Content: part}
 		if i < len(parts)-1 {
-			messageToSend += "\n\n"
+			data.Content += "\n\n"
+		} else {
+			data.Components = components
 		}
 
-		_, err := bot.SendMessage(channelID, messageToSend)
+		msg, err := bot.SendMessageComplex(channelID, data)
 		if err != nil {
-			return err
+			return sent, err
 		}
+		sent = append(sent, msg.ID)
 	}
 
-	return nil
+	return sent, nil
 }
 
 func splitMessage(text string, maxLength int) []string {
@@ -2,112 +2,840 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxConversationTitle is the longest conversation title kept
+	maxConversationTitle = 60
+	// titleMaxTokens bounds the response that names a conversation
+	titleMaxTokens = 60
+)
+
+// TitlePrompt asks for a conversation title after the first exchange
+const TitlePrompt = `Write a short title, at most six words, for the conversation below. Use the language of the conversation. Reply with the title only, without quotes or punctuation at the end.`
+
+// ContinuePrompt asks the model to carry on with a reply that was cut off
+const ContinuePrompt = `Your last reply was cut off. Continue it exactly where it stopped, without repeating anything or introducing the continuation.`
+
+// Errors of Regenerate and Continue
+var (
+	ErrReplyGone      = errors.New("this reply is no longer in the history")
+	ErrNotLatestReply = errors.New("only the latest reply of a conversation can be regenerated or continued")
+	ErrNoPrompt       = errors.New("there is no message to answer again")
 )
 
 // MLService routes requests to the correct AI provider and manages conversation history
 type MLService struct {
 	providers map[string]AIProvider
-	dbManager *DatabaseManager
+	catalog   *ModelCatalog
+	failover  FailoverPolicy
+	quotas    *QuotaService
+	tools     *ToolRegistry
+	// contextPolicy limits the history sent with each request
+	contextPolicy ContextPolicy
+	dbManager     *DatabaseManager
+}
+
+// ChatUser identifies who sent a message, for history and quota purposes
+type ChatUser struct {
+	ID   string
+	Name string
+	// ChannelID selects the user's active conversation
+	ChannelID string
+	// ThreadID is set in Discord threads, whose history is shared by
+	// everyone taking part instead of kept per user
+	ThreadID string
+	// GuildID is empty for direct messages
+	GuildID string
+	RoleIDs []string
 }
 
 type Message struct {
+	ID       int64  `json:"id"`
 	Role     string `json:"role"`
 	Content  string `json:"content"`
 	Time     string `json:"time"`
 	UserName string `json:"user_name"`
+	// ToolCalls, ToolCallID and ToolName are set on tool turns
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	ToolName   string     `json:"tool_name,omitempty"`
+	// Attachments describe the files sent with a user turn
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// ChatInput is what a user sent: the text and any attached files
+type ChatInput struct {
+	Text   string
+	Images []ImagePart
+	// Documents describe the attached files whose text was added to Text
+	Documents []Attachment
+	// Starter loads the message a thread was started from, which opens the
+	// thread's history. It is only called for a thread's first message.
+	Starter func() *ThreadStarter
+	// MessageID is the Discord message the input came from
+	MessageID string
+	// Edits is the user turn the input replaces after its Discord message
+	// was edited. The conversation forks into a branch at that turn.
+	Edits int64
 }
 
 // NewMLService creates a new instance of MLService
-func NewMLService(dbManager *DatabaseManager, providers map[string]AIProvider) (*MLService, error) {
+func NewMLService(dbManager *DatabaseManager, providers map[string]AIProvider, catalog *ModelCatalog, failover FailoverPolicy, quotas *QuotaService, tools *ToolRegistry, contextPolicy ContextPolicy) (*MLService, error) {
 	return &MLService{
-		providers: providers,
-		dbManager: dbManager,
+		providers:     providers,
+		catalog:       catalog,
+		failover:      failover,
+		quotas:        quotas,
+		tools:         tools,
+		contextPolicy: contextPolicy,
+		dbManager:     dbManager,
 	}, nil
 }
 
+// Reply is the answer to a message
+type Reply struct {
+	// Text is what to show in Discord, including tool notes and footers
+	Text string
+	// MessageID is the assistant turn saved in the history, or 0 when the
+	// text is a notice such as a used up quota
+	MessageID int64
+}
+
+// turn is a reply to generate from the history of a conversation
+type turn struct {
+	conversation Conversation
+	history      []Message
+	// images are attached to the last user message
+	images []ImagePart
+	// prompt is the user's message, which titles new conversations
+	prompt string
+	// replaces is the reply a regeneration replaces. It is deleted once the
+	// new reply is ready.
+	replaces int64
+	// continues is the reply a continuation extends
+	continues int64
+}
+
 // GetResponse processes a user message:
-// 1. Saves the message to history
-// 2. Retrieves conversation history
-// 3. Checks which provider the user selected
-// 4. Sends request to the provider
-// 5. Saves the response to history
-func (ml *MLService) GetResponse(userID, userName, message string) (string, error) {
+// 1. Checks the user's quota
+// 2. Saves the message to history
+// 3. Retrieves conversation history
+// 4. Checks which provider and model the user selected
+// 5. Summarizes the oldest turns when they exceed the model's context budget
+// 6. Sends request to the provider, moving down the failover chain if it fails
+// 7. Runs the tools the model asks for and sends back their results
+// 8. Saves the response to history and records its usage
+func (ml *MLService) GetResponse(user ChatUser, input ChatInput) (Reply, error) {
+	return ml.respond(user, input, nil)
+}
+
+// StreamResponse works like GetResponse but streams the reply through onDelta
+// when the user's provider supports streaming
+func (ml *MLService) StreamResponse(user ChatUser, input ChatInput, onDelta func(string)) (Reply, error) {
+	return ml.respond(user, input, onDelta)
+}
+
+// SupportsStreaming reports whether the user's selected provider can stream responses
+func (ml *MLService) SupportsStreaming(userID string) bool {
+	db, err := ml.dbManager.GetUserDB(userID)
+	if err != nil {
+		return false
+	}
+
+	providerName, _, err := db.GetUserPreference(userID)
+	if err != nil {
+		return false
+	}
+
+	_, ok := ml.providers[providerName].(StreamingProvider)
+	return ok
+}
+
+// HistoryDB returns the database holding the user's history: their own, or
+// the shared one of the thread they write in
+func (ml *MLService) HistoryDB(user ChatUser) (*DBService, error) {
+	if user.ThreadID != "" {
+		db, err := ml.dbManager.GetThreadDB(user.ThreadID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get thread DB: %w", err)
+		}
+		return db, nil
+	}
+	db, err := ml.dbManager.GetUserDB(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get user DB: %w", err)
+	}
+	return db, nil
+}
+
+// respond implements GetResponse and StreamResponse. The provider is asked to
+// stream only when onDelta is set and it implements StreamingProvider.
+func (ml *MLService) respond(user ChatUser, input ChatInput, onDelta func(string)) (Reply, error) {
+	userID, userName := user.ID, user.Name
 	db, err := ml.dbManager.GetUserDB(userID)
 	if err != nil {
-		return "", fmt.Errorf("could not get user DB: %w", err)
+		return Reply{}, fmt.Errorf("could not get user DB: %w", err)
 	}
 
-	// Save incoming user message
-	if err := db.AddMessage(userID, userName, "user", message); err != nil {
-		return "", fmt.Errorf("failed to save user message: %v", err)
+	// Refuse before anything is saved or sent once an allowance is used up
+	quota, err := ml.quotas.Check(user)
+	if err != nil {
+		return Reply{}, fmt.Errorf("could not check quota: %w", err)
+	}
+	if quota.Exceeded != "" {
+		return Reply{Text: quota.Exceeded}, nil
+	}
+
+	// Threads keep their history apart from the history of each user
+	historyDB, err := ml.HistoryDB(user)
+	if err != nil {
+		return Reply{}, err
+	}
+	var conversation Conversation
+	if input.Edits != 0 {
+		// The branch continues in the channel; the old turns stay in the
+		// conversation it was forked from
+		conversation, err = historyDB.ForkConversation(input.Edits)
+		if err == nil {
+			err = historyDB.SetActiveConversation(user.ChannelID, conversation.ID)
+		}
+	} else {
+		conversation, err = historyDB.ActiveConversation(user.ChannelID)
+	}
+	if err != nil {
+		return Reply{}, fmt.Errorf("could not get conversation: %w", err)
+	}
+	if conversation.Messages == 0 && input.Starter != nil {
+		if starter := input.Starter(); starter != nil {
+			ml.saveStarter(historyDB, conversation.ID, *starter)
+		}
+	}
+
+	// Save incoming user message; images are only described in the history
+	attachments := append(imageAttachments(input.Images), input.Documents...)
+	if err := historyDB.AddUserMessage(conversation.ID, userID, userName, input.Text, attachments, input.MessageID); err != nil {
+		return Reply{}, fmt.Errorf("failed to save user message: %v", err)
 	}
 
 	// Load full conversation history for context
-	history, err := db.GetMessages()
+	history, err := historyDB.GetMessages(conversation.ID)
 	if err != nil {
-		return "", fmt.Errorf("failed to load conversation history: %v", err)
+		return Reply{}, fmt.Errorf("failed to load conversation history: %v", err)
 	}
 
-	// Build full prompt with conversation history
-	prompt := ml.buildPrompt(history)
+	t := turn{conversation: conversation, history: history, images: input.Images, prompt: input.Text}
+	return ml.generate(user, db, historyDB, t, quota, onDelta)
+}
 
-	// Get user settings (which provider they selected)
-	providerName, _, err := db.GetUserPreference(userID)
+// Regenerate answers the prompt of the latest reply of a conversation again.
+// The new reply takes the place of the old one in the history.
+func (ml *MLService) Regenerate(user ChatUser, messageID int64, onDelta func(string)) (Reply, error) {
+	t, db, historyDB, quota, err := ml.replyTurn(user, messageID)
+	if err != nil || quota.Exceeded != "" {
+		return Reply{Text: quota.Exceeded}, err
+	}
+
+	// The old reply and its tool calls are left out of the request
+	end := slices.IndexFunc(t.history, func(msg Message) bool { return msg.ID == messageID })
+	for end > 0 && t.history[end-1].Role != RoleUser {
+		end--
+	}
+	if end <= 0 {
+		return Reply{}, ErrNoPrompt
+	}
+	t.history = t.history[:end]
+	t.replaces = messageID
+	return ml.generate(user, db, historyDB, t, quota, onDelta)
+}
+
+// Continue asks the model to carry on with the latest reply of a
+// conversation, for answers cut off by the token limit. The continuation is
+// added to the reply in the history.
+func (ml *MLService) Continue(user ChatUser, messageID int64, onDelta func(string)) (Reply, error) {
+	t, db, historyDB, quota, err := ml.replyTurn(user, messageID)
+	if err != nil || quota.Exceeded != "" {
+		return Reply{Text: quota.Exceeded}, err
+	}
+	t.continues = messageID
+	return ml.generate(user, db, historyDB, t, quota, onDelta)
+}
+
+// replyTurn loads what Regenerate and Continue need to work on a reply, which
+// must be the latest turn of its conversation
+func (ml *MLService) replyTurn(user ChatUser, messageID int64) (turn, *DBService, *DBService, QuotaStatus, error) {
+	db, err := ml.dbManager.GetUserDB(user.ID)
+	if err != nil {
+		return turn{}, nil, nil, QuotaStatus{}, fmt.Errorf("could not get user DB: %w", err)
+	}
+	historyDB, err := ml.HistoryDB(user)
+	if err != nil {
+		return turn{}, nil, nil, QuotaStatus{}, err
+	}
+
+	reply, err := historyDB.GetReply(messageID)
+	if err == sql.ErrNoRows {
+		return turn{}, nil, nil, QuotaStatus{}, ErrReplyGone
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not get user preferences: %w", err)
+		return turn{}, nil, nil, QuotaStatus{}, fmt.Errorf("could not get reply: %w", err)
+	}
+	if !reply.Latest {
+		return turn{}, nil, nil, QuotaStatus{}, ErrNotLatestReply
+	}
+
+	quota, err := ml.quotas.Check(user)
+	if err != nil {
+		return turn{}, nil, nil, QuotaStatus{}, fmt.Errorf("could not check quota: %w", err)
+	}
+
+	conversation, err := historyDB.GetConversation(reply.ConversationID)
+	if err != nil {
+		return turn{}, nil, nil, QuotaStatus{}, fmt.Errorf("could not get conversation: %w", err)
+	}
+	history, err := historyDB.GetMessages(conversation.ID)
+	if err != nil {
+		return turn{}, nil, nil, QuotaStatus{}, fmt.Errorf("failed to load conversation history: %v", err)
+	}
+	return turn{conversation: conversation, history: history}, db, historyDB, quota, nil
+}
+
+// generate writes a reply to a turn with the user's provider and saves it.
+// db is the user's database, which holds their settings and usage, and
+// historyDB the one holding the conversation.
+func (ml *MLService) generate(user ChatUser, db, historyDB *DBService, t turn, quota QuotaStatus, onDelta func(string)) (Reply, error) {
+	userID := user.ID
+	conversation := t.conversation
+
+	params, err := db.GetGenerationParams(userID)
+	if err != nil {
+		fmt.Printf("Warning: could not get generation parameters: %v\n", err)
+	}
+
+	// Get user settings (which provider and model they selected)
+	providerName, modelName, err := db.GetUserPreference(userID)
+	if err != nil {
+		return Reply{}, fmt.Errorf("could not get user preferences: %w", err)
 	}
 
 	// Check that provider is selected - no fallback to default
 	if providerName == "none" || providerName == "" {
-		return "Please select an AI provider first using /provider name:<provider>", nil
+		return Reply{Text: "Please select an AI provider first using /provider name:<provider>"}, nil
 	}
 
-	// Get provider instance
-	provider, exists := ml.providers[providerName]
-	if !exists {
-		return fmt.Sprintf("Provider '%s' not found. Available providers: %s",
+	// Check that the provider exists
+	if _, exists := ml.providers[providerName]; !exists {
+		return Reply{Text: fmt.Sprintf("Provider '%s' not found. Available providers: %s",
 			providerName,
-			ml.getAvailableProvidersStr()), nil
+			ml.getAvailableProvidersStr())}, nil
 	}
 
-	ctx := context.Background()
-	response, err := provider.GetResponse(ctx, prompt)
+	// Use the user's model, or the provider default when none is selected
+	primaryModel, err := ml.ResolveModel(providerName, modelName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get response from %s: %v", providerName, err)
+		return Reply{Text: fmt.Sprintf("%v. Use /model to pick another one.", err)}, nil
 	}
+	primary := FailoverTarget{Provider: providerName, Model: primaryModel}
 
+	chain, err := db.GetFailoverChain(userID)
+	if err != nil {
+		fmt.Printf("Warning: could not get failover chain: %v\n", err)
+	}
+	targets := ml.failoverTargets(primary, chain)
+
+	// Keep the history within the primary model's context budget; older
+	// turns are sent as a summary ahead of the recent ones
+	ctx := context.Background()
+	system := ml.buildPrompt(db, userID)
+	history, summary := ml.fitContext(ctx, user, historyDB, conversation.ID, t.history, primary, params, system, len(t.images))
+	if user.ThreadID != "" {
+		history = labelSpeakers(history)
+	}
+
+	// Build the conversation sent to the provider, with the images of this
+	// turn attached to the last user message
+	req := ml.buildRequest(system, history)
+	if summary != "" {
+		req.System += summaryContext(summary)
+	}
+	if last := len(req.Messages) - 1; last >= 0 && len(t.images) > 0 {
+		req.Messages[last].Images = t.images
+	}
+	req.Params = params
+
+	// A continuation is asked for like a user turn that isn't saved, and
+	// without tools, since the reply it extends is already saved
+	if t.continues != 0 {
+		req.Messages = append(req.Messages, ChatMessage{Role: RoleUser, Content: ContinuePrompt})
+	} else {
+		req.Tools = ml.tools.Definitions()
+	}
+
+	// Each step is one model call; tool calls and their results are added
+	// to the request until the model answers. The last step offers no tools
+	// so that it has to answer.
+	var display strings.Builder
+	var result providerResult
+	var usage UsageRecord
+	for step := 1; ; step++ {
+		if step >= ml.tools.MaxSteps() {
+			req.Tools = nil
+		}
+
+		result, err = ml.callWithFailover(ctx, req, targets, onDelta)
+		if err != nil {
+			return Reply{}, err
+		}
+		usage = addUsage(usage, ml.usageRecord(result))
+
+		if len(result.ToolCalls) == 0 || len(req.Tools) == 0 {
+			break
+		}
+
+		display.WriteString(result.Content)
+		notes := ml.runToolCalls(ctx, user, historyDB, conversation.ID, &req, result.Content, result.ToolCalls)
+		if display.Len() > 0 && !strings.HasSuffix(display.String(), "\n") {
+			notes = "\n" + notes
+		}
+		display.WriteString(notes)
+		if onDelta != nil {
+			onDelta(notes)
+		}
+	}
+
+	response := result.Content
 	if response == "" {
-		return "Sorry, I cannot respond to this.", nil
+		response = "Sorry, I cannot respond to this."
 	}
 
-	// Save assistant response to history
-	db, err = ml.dbManager.GetUserDB(userID)
+	// Save assistant response to history along with its usage. The usage
+	// stays with the user, who pays for it, also in a shared thread.
+	var messageID int64
+	if t.continues != 0 {
+		messageID = t.continues
+		err = historyDB.AppendToReply(messageID, "\n\n"+response)
+	} else {
+		if t.replaces != 0 {
+			if err := historyDB.DeleteReply(t.replaces, false); err != nil {
+				fmt.Printf("Warning: failed to delete regenerated reply: %v\n", err)
+			}
+		}
+		messageID, err = historyDB.AddAssistantMessage(conversation.ID, userID, "Kurosawa", response, result.Target)
+	}
 	if err != nil {
-		fmt.Printf("Warning: could not get user DB to save assistant message: %v\n", err)
+		fmt.Printf("Warning: failed to save assistant message: %v\n", err)
+	}
+	usageMessageID := messageID
+	if historyDB != db {
+		usageMessageID = 0
+	}
+	if err := db.AddUsage(usageMessageID, usage); err != nil {
+		fmt.Printf("Warning: failed to save usage: %v\n", err)
+	}
+	if err := ml.quotas.Record(user, usage, true); err != nil {
+		fmt.Printf("Warning: failed to record quota usage: %v\n", err)
+	}
+
+	// Untitled conversations are named after their first exchange; threads
+	// already have a name
+	if conversation.Title == "" && user.ThreadID == "" && t.prompt != "" {
+		go ml.titleConversation(user, historyDB, conversation.ID, t.prompt, response, primary)
+	}
+
+	// Tool notes and footers are only shown, never stored in the history
+	response = display.String() + response
+	if result.Target != primary {
+		response += failoverFooter(primary, result.Target)
+	}
+	if quota.Warning != "" {
+		response += "\n\n-# " + quota.Warning
+	}
+
+	return Reply{Text: response, MessageID: messageID}, nil
+}
+
+// failoverTargets returns the providers to try in order: the primary, then the
+// user's chain or, if they have none, the admin's default chain. Entries that
+// aren't configured or repeat an earlier one are skipped.
+func (ml *MLService) failoverTargets(primary FailoverTarget, userChain string) []FailoverTarget {
+	chain := parseFailoverChain(userChain)
+	if len(chain) == 0 {
+		chain = ml.failover.Chain
+	}
+
+	targets := []FailoverTarget{primary}
+	for _, target := range chain {
+		model, err := ml.ResolveModel(target.Provider, target.Model)
+		if err != nil {
+			fmt.Printf("Warning: skipping failover target %s: %v\n", target, err)
+			continue
+		}
+		target.Model = model
+
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// runToolCalls runs the tools a response asked for, adds the calls and their
+// results to the request and the history, and returns a note per call
+func (ml *MLService) runToolCalls(ctx context.Context, user ChatUser, db *DBService, conversationID int64, req *ChatRequest, content string, calls []ToolCall) string {
+	for i := range calls {
+		// Gemini doesn't always give calls an ID, which other providers need
+		// if the conversation moves to them
+		if calls[i].ID == "" {
+			calls[i].ID = newToolCallID()
+		}
+		if calls[i].Arguments == "" {
+			calls[i].Arguments = "{}"
+		}
+	}
+
+	req.Messages = append(req.Messages, ChatMessage{Role: RoleAssistant, Content: content, ToolCalls: calls})
+	if err := db.AddToolCallMessage(conversationID, user.ID, "Kurosawa", content, calls); err != nil {
+		fmt.Printf("Warning: failed to save tool calls: %v\n", err)
+	}
+
+	var notes strings.Builder
+	for _, call := range calls {
+		output := ml.tools.Run(ctx, user, call)
+		req.Messages = append(req.Messages, ChatMessage{Role: RoleTool, Content: output, ToolCallID: call.ID, ToolName: call.Name})
+		if err := db.AddToolResult(conversationID, user.ID, call, output); err != nil {
+			fmt.Printf("Warning: failed to save tool result: %v\n", err)
+		}
+		notes.WriteString(toolCallNote(call))
+	}
+	return notes.String()
+}
+
+// titleConversation names a conversation after its first exchange with the
+// summary model. A cut of the user's message serves when that fails.
+func (ml *MLService) titleConversation(user ChatUser, db *DBService, conversationID int64, message, response string, primary FailoverTarget) {
+	title := conversationTitle(message)
+
+	req := ChatRequest{
+		System: TitlePrompt,
+		Messages: []ChatMessage{{
+			Role:    RoleUser,
+			Content: fmt.Sprintf("User: %s\n\nAssistant: %s", truncate(message, summaryTurnChars), truncate(response, summaryTurnChars)),
+		}},
+		Params: GenerationParams{MaxTokens: titleMaxTokens},
+	}
+	result, err := ml.callWithFailover(context.Background(), req, ml.summaryTargets(primary), nil)
+	if err != nil {
+		fmt.Printf("Warning: could not title conversation: %v\n", err)
 	} else {
-		if err := db.AddMessage(userID, "Kurosawa", "assistant", response); err != nil {
-			fmt.Printf("Warning: failed to save assistant message: %v\n", err)
+		ml.recordUsage(user, ml.usageRecord(result))
+		if generated := conversationTitle(strings.Trim(result.Content, "\"'*# ")); generated != "" {
+			title = generated
 		}
 	}
 
-	return response, nil
+	if title == "" {
+		title = "Untitled conversation"
+	}
+	if err := db.SetConversationTitle(conversationID, title); err != nil {
+		fmt.Printf("Warning: failed to save conversation title: %v\n", err)
+	}
 }
 
-// buildPrompt constructs the full prompt from system prompt and conversation history
-func (ml *MLService) buildPrompt(messages []Message) string {
-	prompt := SystemPrompt + "\n\nConversation history:\n"
+// conversationTitle cleans a title down to one short line
+func conversationTitle(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return truncate(strings.TrimSpace(line), maxConversationTitle)
+}
 
-	for _, msg := range messages {
-		if msg.Role == "user" {
-			prompt += fmt.Sprintf("%s: %s\n", msg.UserName, msg.Content)
+// recordUsage saves the usage of a call that isn't a reply, such as a
+// summary or a title, and counts its tokens and cost against the user's
+// quota. It isn't one of the user's messages, so it doesn't count as one.
+func (ml *MLService) recordUsage(user ChatUser, usage UsageRecord) {
+	db, err := ml.dbManager.GetUserDB(user.ID)
+	if err == nil {
+		err = db.AddUsage(0, usage)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save usage: %v\n", err)
+	}
+	if err := ml.quotas.Record(user, usage, false); err != nil {
+		fmt.Printf("Warning: failed to record quota usage: %v\n", err)
+	}
+}
+
+// toolCallNote is the line shown in Discord for a tool call, e.g.
+// "-# 🔧 calculate(2+2)"
+func toolCallNote(call ToolCall) string {
+	args := call.Arguments
+	// A single argument is shown without its name
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(args), &parsed); err == nil && len(parsed) <= 1 {
+		args = ""
+		for _, value := range parsed {
+			args = fmt.Sprint(value)
+		}
+	}
+	args = strings.ReplaceAll(args, "\n", " ")
+	return fmt.Sprintf("-# 🔧 %s(%s)\n", call.Name, truncate(args, 80))
+}
+
+// newToolCallID returns a random 9-character alphanumeric ID, the format
+// Mistral requires
+func newToolCallID() string {
+	return rand.Text()[:9]
+}
+
+// addUsage adds the usage of a step to the total of a response. The provider
+// and model are those of the last step.
+func addUsage(total, step UsageRecord) UsageRecord {
+	step.PromptTokens += total.PromptTokens
+	step.CompletionTokens += total.CompletionTokens
+	step.Cost += total.Cost
+	step.Latency += total.Latency
+	return step
+}
+
+// providerResult is a response along with where it came from and how long it took
+type providerResult struct {
+	ChatResponse
+	Target  FailoverTarget
+	Latency time.Duration
+}
+
+// callWithFailover sends the request to each target in turn until one answers.
+// It moves on only for the error kinds of the failover policy, and never once
+// a stream has started showing text to the user. Requests with images skip
+// the targets without vision.
+func (ml *MLService) callWithFailover(ctx context.Context, req ChatRequest, targets []FailoverTarget, onDelta func(string)) (providerResult, error) {
+	var err error
+	for i, target := range targets {
+		provider := ml.providers[target.Provider]
+
+		if vision, ok := provider.(VisionProvider); hasImages(req) && (!ok || !vision.SupportsVision(target.Model)) {
+			err = &ProviderError{Kind: ErrNoVision, Provider: provider.GetName(), Message: target.Model}
+			continue
+		}
+
+		targetReq := req
+		if tools, ok := provider.(ToolProvider); len(req.Tools) == 0 || !ok || !tools.SupportsTools() {
+			targetReq = withoutTools(req)
+		}
+		targetReq.Model = target.Model
+
+		var response ChatResponse
+		started := false
+		start := time.Now()
+		if streamer, ok := provider.(StreamingProvider); ok && onDelta != nil {
+			response, err = streamer.StreamResponse(ctx, targetReq, func(delta string) {
+				started = true
+				onDelta(delta)
+			})
 		} else {
-			prompt += fmt.Sprintf("%s: %s\n", msg.UserName, msg.Content)
+			response, err = provider.GetResponse(ctx, targetReq)
+		}
+		if err == nil {
+			return providerResult{ChatResponse: response, Target: target, Latency: time.Since(start)}, nil
+		}
+
+		err = fmt.Errorf("failed to get response from %s: %w", target.Provider, err)
+		if started || i == len(targets)-1 || !isErrorKind(err, ml.failover.On) {
+			break
+		}
+		fmt.Printf("Warning: %v; failing over to %s\n", err, targets[i+1])
+	}
+	return providerResult{}, err
+}
+
+// hasImages reports whether any turn of the request carries images
+func hasImages(req ChatRequest) bool {
+	for _, msg := range req.Messages {
+		if len(msg.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// usageRecord builds the usage stored for a response. When the provider
+// doesn't report a cost it is estimated from the model's catalog prices.
+func (ml *MLService) usageRecord(result providerResult) UsageRecord {
+	cost := result.Usage.Cost
+	if cost == 0 {
+		provider := ml.providers[result.Target.Provider]
+		if info, ok := ml.catalog.Find(result.Target.Provider, provider, result.Target.Model); ok {
+			cost = (float64(result.Usage.PromptTokens)*info.PromptPrice +
+				float64(result.Usage.CompletionTokens)*info.CompletionPrice) / 1_000_000
 		}
 	}
 
-	prompt += "\n"
-	return prompt
+	return UsageRecord{
+		Provider:         result.Target.Provider,
+		Model:            result.Target.Model,
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+		Cost:             cost,
+		Latency:          result.Latency,
+	}
+}
+
+// buildPrompt returns the system prompt of a user's requests: the one of
+// their active persona, or the default Kurosawa prompt
+func (ml *MLService) buildPrompt(db *DBService, userID string) string {
+	persona, ok, err := db.ActivePersona(userID)
+	if err != nil {
+		fmt.Printf("Warning: could not get active persona: %v\n", err)
+	}
+	if !ok {
+		return SystemPrompt
+	}
+	return persona.Prompt
+}
+
+// buildRequest constructs the provider request from the system prompt and
+// conversation history. Consecutive turns with the same role are merged so
+// that the result always alternates between user and assistant. Tool results
+// follow the call they answer; results without a call are dropped and calls
+// left without a result get an error result.
+func (ml *MLService) buildRequest(system string, messages []Message) ChatRequest {
+	req := ChatRequest{System: system}
+
+	var pending []ToolCall
+	closePending := func() {
+		for _, call := range pending {
+			req.Messages = append(req.Messages, ChatMessage{
+				Role:       RoleTool,
+				Content:    "Error: the tool did not return a result",
+				ToolCallID: call.ID,
+				ToolName:   call.Name,
+			})
+		}
+		pending = nil
+	}
+
+	for _, msg := range messages {
+		if msg.Role == RoleTool {
+			i := slices.IndexFunc(pending, func(call ToolCall) bool { return call.ID == msg.ToolCallID })
+			if i < 0 {
+				continue
+			}
+			pending = slices.Delete(pending, i, i+1)
+			req.Messages = append(req.Messages, ChatMessage{
+				Role:       RoleTool,
+				Content:    msg.Content,
+				ToolCallID: msg.ToolCallID,
+				ToolName:   msg.ToolName,
+			})
+			continue
+		}
+		if msg.Role != RoleUser && msg.Role != RoleAssistant {
+			continue
+		}
+		closePending()
+
+		if len(msg.ToolCalls) > 0 {
+			req.Messages = append(req.Messages, ChatMessage{
+				Role:      RoleAssistant,
+				Content:   msg.Content,
+				ToolCalls: msg.ToolCalls,
+			})
+			pending = slices.Clone(msg.ToolCalls)
+			continue
+		}
+
+		content := attachmentNote(msg.Attachments) + msg.Content
+		last := len(req.Messages) - 1
+		if last >= 0 && req.Messages[last].Role == msg.Role && len(req.Messages[last].ToolCalls) == 0 {
+			req.Messages[last].Content += "\n\n" + content
+			continue
+		}
+
+		req.Messages = append(req.Messages, ChatMessage{
+			Role:    msg.Role,
+			Content: content,
+		})
+	}
+	closePending()
+
+	return req
+}
+
+// withoutTools prepares a request for a call without tools: the definitions
+// are dropped and tool turns are rewritten as plain text, so that the model
+// still sees what the tools returned
+func withoutTools(req ChatRequest) ChatRequest {
+	flat := req
+	flat.Tools = nil
+	flat.Messages = nil
+
+	for _, msg := range req.Messages {
+		role, content := msg.Role, msg.Content
+		if msg.Role == RoleTool {
+			role = RoleUser
+			content = fmt.Sprintf("[%s result]\n%s", msg.ToolName, msg.Content)
+		}
+		for _, call := range msg.ToolCalls {
+			content = strings.TrimSpace(content + fmt.Sprintf("\n[called %s(%s)]", call.Name, call.Arguments))
+		}
+
+		last := len(flat.Messages) - 1
+		if last >= 0 && flat.Messages[last].Role == role {
+			flat.Messages[last].Content += "\n\n" + content
+			flat.Messages[last].Images = append(flat.Messages[last].Images, msg.Images...)
+			continue
+		}
+		flat.Messages = append(flat.Messages, ChatMessage{Role: role, Content: content, Images: msg.Images})
+	}
+	return flat
+}
+
+// ResolveModel returns the model to use with a provider: the user's selection
+// when the provider offers it, or the provider default when none is selected
+func (ml *MLService) ResolveModel(providerName, model string) (string, error) {
+	provider, exists := ml.providers[providerName]
+	if !exists {
+		return "", fmt.Errorf("provider '%s' not found", providerName)
+	}
+
+	if model == "" || model == "none" {
+		return provider.GetDefaultModel(), nil
+	}
+
+	if model == provider.GetDefaultModel() {
+		return model, nil
+	}
+	if _, ok := ml.catalog.Find(providerName, provider, model); ok {
+		return model, nil
+	}
+
+	return "", fmt.Errorf("model '%s' is not available for %s", model, provider.GetName())
+}
+
+// GetModels returns the models offered by a provider, discovered live when possible
+func (ml *MLService) GetModels(providerName string) []ModelInfo {
+	provider, exists := ml.providers[providerName]
+	if !exists {
+		return nil
+	}
+	return ml.catalog.Models(providerName, provider)
+}
+
+// RefreshModels discards the cached model list of a provider and fetches it again
+func (ml *MLService) RefreshModels(providerName string) []ModelInfo {
+	ml.catalog.Refresh(providerName)
+	return ml.GetModels(providerName)
+}
+
+// DefaultFailoverChain returns the chain used by users who haven't set their own
+func (ml *MLService) DefaultFailoverChain() []FailoverTarget {
+	return ml.failover.Chain
 }
 
 // GetProvider returns a provider by name
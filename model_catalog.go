@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultModelCatalogTTL is how long a discovered model list is trusted
+	DefaultModelCatalogTTL = 6 * time.Hour
+
+	// modelDiscoveryRetryAfter is how long the fallback list is served after
+	// a failed discovery before it is tried again
+	modelDiscoveryRetryAfter = 5 * time.Minute
+
+	modelDiscoveryTimeout = 15 * time.Second
+)
+
+// ModelCatalog caches the live model lists of providers that implement
+// ModelLister. Providers without discovery, or whose discovery fails, fall
+// back to their static GetAvailableModels list. A failed discovery is not
+// retried until modelDiscoveryRetryAfter has passed.
+type ModelCatalog struct {
+	ttl     time.Duration
+	entries map[string]modelCatalogEntry
+	mu      sync.Mutex
+}
+
+type modelCatalogEntry struct {
+	models    []ModelInfo
+	expiresAt time.Time
+}
+
+// modelCatalogTTLFromEnv reads MODEL_CATALOG_TTL; 0 when it isn't set
+func modelCatalogTTLFromEnv() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv("MODEL_CATALOG_TTL"))
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("MODEL_CATALOG_TTL must be a positive Go duration, e.g. 6h")
+	}
+	return ttl, nil
+}
+
+func NewModelCatalog(ttl time.Duration) *ModelCatalog {
+	if ttl <= 0 {
+		ttl = DefaultModelCatalogTTL
+	}
+	return &ModelCatalog{
+		ttl:     ttl,
+		entries: make(map[string]modelCatalogEntry),
+	}
+}
+
+// Models returns the models offered by a provider, fetching them when the
+// cached list is missing or expired
+func (c *ModelCatalog) Models(name string, provider AIProvider) []ModelInfo {
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.models
+	}
+
+	lister, ok := provider.(ModelLister)
+	if !ok {
+		return staticModels(provider)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modelDiscoveryTimeout)
+	defer cancel()
+
+	models, err := lister.ListModels(ctx)
+	if err != nil || len(models) == 0 {
+		if err != nil {
+			log.Printf("Model discovery for %s failed, using static list: %v", name, err)
+		}
+		// Keep serving a stale list rather than the static one if we have
+		// it, and remember the fallback so every lookup doesn't wait on a
+		// provider that is down
+		fallback := entry.models
+		if fallback == nil {
+			fallback = staticModels(provider)
+		}
+		c.mu.Lock()
+		c.entries[name] = modelCatalogEntry{models: fallback, expiresAt: time.Now().Add(modelDiscoveryRetryAfter)}
+		c.mu.Unlock()
+		return fallback
+	}
+
+	c.mu.Lock()
+	c.entries[name] = modelCatalogEntry{models: models, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return models
+}
+
+// Refresh drops the cached list of a provider so the next lookup fetches it again
+func (c *ModelCatalog) Refresh(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// Find returns the catalog entry for a model, if the provider offers it
+func (c *ModelCatalog) Find(name string, provider AIProvider, model string) (ModelInfo, bool) {
+	for _, m := range c.Models(name, provider) {
+		if m.ID == model {
+			return m, true
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// staticModels converts a provider's hardcoded model list to ModelInfo
+func staticModels(provider AIProvider) []ModelInfo {
+	names := provider.GetAvailableModels()
+	models := make([]ModelInfo, 0, len(names))
+	for _, id := range names {
+		models = append(models, ModelInfo{ID: id})
+	}
+	return models
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenAICompatibleConfig describes an endpoint that speaks the OpenAI chat
+// completions protocol (Mistral, OpenRouter, Ollama, vLLM, LM Studio, llama.cpp...)
+type OpenAICompatibleConfig struct {
+	// Name is shown to users and used in error messages
+	Name string
+	// BaseURL is the API root, e.g. https://api.mistral.ai/v1
+	BaseURL string
+	// APIKey is optional; local servers usually don't need one
+	APIKey string
+	// APIKeyEnv names the variable holding APIKey, for error messages
+	APIKeyEnv    string
+	DefaultModel string
+	Models       []string
+	// StatusPage is linked when the service is unavailable
+	StatusPage string
+	// Headers are extra HTTP headers sent with every request
+	Headers map[string]string
+	// Dialect selects the request fields the endpoint understands for
+	// generation parameters; see the Dialect* constants
+	Dialect string
+	// StreamUsage asks for token usage at the end of a stream with
+	// stream_options; leave it off for servers that send it anyway
+	StreamUsage bool
+	// ReportCost asks OpenRouter to include the cost of each request
+	ReportCost bool
+	// Tools enables function calling; many local servers don't support it
+	Tools bool
+	// Vision marks every model as accepting images; VisionModels lists
+	// substrings of the model names that do when only some of them can
+	Vision       bool
+	VisionModels []string
+	// ReasoningModels lists substrings of the model names that take a
+	// reasoning effort instead of sampling settings, besides OpenAI's
+	// reasoning models, which are recognized by name. Only the OpenAI
+	// dialect uses it.
+	ReasoningModels []string
+}
+
+// Dialects of the OpenAI chat completions protocol
+const (
+	// DialectOpenAI sends seed and reasoning_effort like the OpenAI API
+	DialectOpenAI = ""
+	// DialectMistral sends random_seed and no reasoning effort
+	DialectMistral = "mistral"
+	// DialectOpenRouter sends reasoning effort as reasoning.effort
+	DialectOpenRouter = "openrouter"
+)
+
+type OpenAICompatibleProvider struct {
+	config OpenAICompatibleConfig
+	client *http.Client
+}
+
+type ChatCompletionRequest struct {
+	Model           string                  `json:"model"`
+	Messages        []ChatCompletionMessage `json:"messages"`
+	Stream          bool                    `json:"stream,omitempty"`
+	StreamOptions   *ChatStreamOptions      `json:"stream_options,omitempty"`
+	Usage           *UsageOptions           `json:"usage,omitempty"`
+	Temperature     *float64                `json:"temperature,omitempty"`
+	TopP            *float64                `json:"top_p,omitempty"`
+	MaxTokens       int                     `json:"max_tokens,omitempty"`
+	Seed            *int64                  `json:"seed,omitempty"`
+	RandomSeed      *int64                  `json:"random_seed,omitempty"`
+	Stop            []string                `json:"stop,omitempty"`
+	ReasoningEffort string                  `json:"reasoning_effort,omitempty"`
+	Reasoning       *ReasoningOptions       `json:"reasoning,omitempty"`
+	Tools           []ChatCompletionTool    `json:"tools,omitempty"`
+}
+
+// ChatCompletionTool declares a function the model may call
+type ChatCompletionTool struct {
+	Type     string                 `json:"type"`
+	Function ChatCompletionFunction `json:"function"`
+}
+
+type ChatCompletionFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+// ChatCompletionToolCall is a function call made by the model
+type ChatCompletionToolCall struct {
+	// Index identifies the call across streamed deltas
+	Index    int    `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// ReasoningOptions is OpenRouter's reasoning switch
+type ReasoningOptions struct {
+	Effort string `json:"effort"`
+}
+
+type ChatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// UsageOptions is OpenRouter's usage accounting switch
+type UsageOptions struct {
+	Include bool `json:"include"`
+}
+
+type ChatCompletionMessage struct {
+	Role       string                   `json:"role"`
+	Content    string                   `json:"content"`
+	ToolCalls  []ChatCompletionToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string                   `json:"tool_call_id,omitempty"`
+	// Name is the function a tool message answers; Mistral requires it
+	Name string `json:"name,omitempty"`
+	// Parts replaces Content with text and image parts when set
+	Parts []ChatContentPart `json:"-"`
+}
+
+// ChatContentPart is a text or image_url part of a multimodal message
+type ChatContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *ChatImageURL `json:"image_url,omitempty"`
+}
+
+type ChatImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON sends Parts as the content when the message has them
+func (m ChatCompletionMessage) MarshalJSON() ([]byte, error) {
+	type plain ChatCompletionMessage
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ChatContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   ChatCompletionUsage    `json:"usage"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int                   `json:"index"`
+	Message      ChatCompletionMessage `json:"message"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// Cost is only reported by OpenRouter
+	Cost float64 `json:"cost,omitempty"`
+}
+
+func (u ChatCompletionUsage) toUsage() Usage {
+	return Usage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		Cost:             u.Cost,
+	}
+}
+
+// modelListResponse is the /models response. Besides the standard fields it
+// understands the extensions Mistral and OpenRouter add.
+type modelListResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+		// OpenRouter
+		ContextLength int `json:"context_length"`
+		Pricing       *struct {
+			// US dollars per token, as decimal strings
+			Prompt     string `json:"prompt"`
+			Completion string `json:"completion"`
+		} `json:"pricing"`
+		// Mistral
+		MaxContextLength int `json:"max_context_length"`
+		Capabilities     *struct {
+			CompletionChat bool `json:"completion_chat"`
+		} `json:"capabilities"`
+	} `json:"data"`
+}
+
+func NewOpenAICompatibleProvider(config OpenAICompatibleConfig) (*OpenAICompatibleProvider, error) {
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("base URL is required")
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+
+	if config.DefaultModel == "" && len(config.Models) > 0 {
+		config.DefaultModel = config.Models[0]
+	}
+	if config.DefaultModel == "" {
+		return nil, fmt.Errorf("a default model or model list is required")
+	}
+	if len(config.Models) == 0 {
+		config.Models = []string{config.DefaultModel}
+	}
+
+	return &OpenAICompatibleProvider{
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+func (c *OpenAICompatibleProvider) GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	resp, err := c.send(ctx, req, false)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+
+	var respData ChatCompletionResponse
+	if err := json.Unmarshal(respBytes, &respData); err != nil {
+		return ChatResponse{}, err
+	}
+
+	usage := respData.Usage.toUsage()
+	if len(respData.Choices) == 0 {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	response := respData.Choices[0].Message.Content
+	if calls := respData.Choices[0].Message.ToolCalls; len(calls) > 0 {
+		return ChatResponse{Content: response, ToolCalls: toToolCalls(calls), Usage: usage}, nil
+	}
+	if response == "" && respData.Choices[0].FinishReason == "content_filter" {
+		return ChatResponse{}, &ProviderError{Kind: ErrContentBlocked, Provider: c.config.Name, Message: "response stopped by the content filter"}
+	}
+	if response == "" {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	return ChatResponse{Content: response, Usage: usage}, nil
+}
+
+// StreamResponse streams the completion over SSE, calling onDelta for each fragment
+func (c *OpenAICompatibleProvider) StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error) {
+	resp, err := c.send(ctx, req, true)
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	response, err := readChatCompletionStream(resp.Body, onDelta)
+	if err != nil {
+		return ChatResponse{}, asProviderError(c.config.Name, err)
+	}
+
+	if response.Content == "" && len(response.ToolCalls) == 0 {
+		response.Content = "Sorry, I cannot respond to this."
+	}
+
+	return response, nil
+}
+
+// send posts a chat completion request and converts HTTP error statuses into
+// helpful errors. The caller must close the body of the returned response.
+func (c *OpenAICompatibleProvider) send(ctx context.Context, req ChatRequest, stream bool) (*http.Response, error) {
+	model := req.modelOr(c.config.DefaultModel)
+	reqBody := ChatCompletionRequest{
+		Model:    model,
+		Messages: c.buildMessages(req),
+		Stream:   stream,
+	}
+	if stream && c.config.StreamUsage {
+		reqBody.StreamOptions = &ChatStreamOptions{IncludeUsage: true}
+	}
+	if c.config.ReportCost {
+		reqBody.Usage = &UsageOptions{Include: true}
+	}
+	c.applyParams(&reqBody, model, req.Params)
+	if c.config.Tools {
+		for _, tool := range req.Tools {
+			reqBody.Tools = append(reqBody.Tools, ChatCompletionTool{
+				Type: "function",
+				Function: ChatCompletionFunction{
+					Name:        tool.Name,
+					Description: tool.Description,
+					Parameters:  tool.Parameters,
+				},
+			})
+		}
+	}
+
+	bodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := c.newRequest(ctx, "POST", "/chat/completions", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, newTransportError(c.config.Name, err)
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	errBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Add hints for the admin reading the logs
+	providerErr := newHTTPError(c.config.Name, resp, errBytes)
+	switch {
+	case errors.Is(providerErr, ErrAuth):
+		providerErr.Message += fmt.Sprintf(" (check %s in .env)", c.config.APIKeyEnv)
+	case errors.Is(providerErr, ErrUnavailable) && c.config.StatusPage != "":
+		providerErr.Message += fmt.Sprintf(" (status: %s)", c.config.StatusPage)
+	case errors.Is(providerErr, ErrBadRequest):
+		providerErr.Message += fmt.Sprintf(" (model '%s')", model)
+	}
+	return nil, providerErr
+}
+
+// applyParams copies the user's generation parameters into the request,
+// using the field names of the endpoint's dialect
+func (c *OpenAICompatibleProvider) applyParams(reqBody *ChatCompletionRequest, model string, p GenerationParams) {
+	reqBody.MaxTokens = p.MaxTokens
+
+	switch c.config.Dialect {
+	case DialectMistral:
+		reqBody.RandomSeed = p.Seed
+	case DialectOpenRouter:
+		reqBody.Seed = p.Seed
+		if p.ReasoningEffort != "" {
+			reqBody.Reasoning = &ReasoningOptions{Effort: p.ReasoningEffort}
+		}
+	default:
+		reqBody.Seed = p.Seed
+		// Like OpenAI's own, reasoning models take an effort instead of
+		// sampling settings and stop sequences, and other models reject it
+		if c.isReasoningModel(model) {
+			reqBody.ReasoningEffort = openAIReasoningEffort(openAIModelName(model), p.ReasoningEffort)
+			return
+		}
+	}
+
+	reqBody.Temperature = p.Temperature
+	reqBody.TopP = p.TopP
+	reqBody.Stop = p.Stop
+}
+
+// isReasoningModel reports whether a model takes a reasoning effort
+func (c *OpenAICompatibleProvider) isReasoningModel(model string) bool {
+	if isOpenAIReasoningModel(openAIModelName(model)) {
+		return true
+	}
+	for _, name := range c.config.ReasoningModels {
+		if strings.Contains(model, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// openAIModelName strips the vendor prefix gateways put in front of model
+// names, e.g. "openai/o3-mini" becomes "o3-mini"
+func openAIModelName(model string) string {
+	return model[strings.LastIndex(model, "/")+1:]
+}
+
+// ListModels fetches the endpoint's /models catalog
+func (c *OpenAICompatibleProvider) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	httpReq, err := c.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, newTransportError(c.config.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errBytes, _ := io.ReadAll(resp.Body)
+		return nil, newHTTPError(c.config.Name, resp, errBytes)
+	}
+
+	var list modelListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(list.Data))
+	for _, m := range list.Data {
+		// Skip embedding and moderation models when the endpoint tells us
+		if m.Capabilities != nil && !m.Capabilities.CompletionChat {
+			continue
+		}
+
+		info := ModelInfo{ID: m.ID, ContextLength: m.ContextLength}
+		if info.ContextLength == 0 {
+			info.ContextLength = m.MaxContextLength
+		}
+		if m.Pricing != nil {
+			info.PromptPrice = perMillionTokens(m.Pricing.Prompt)
+			info.CompletionPrice = perMillionTokens(m.Pricing.Completion)
+		}
+		models = append(models, info)
+	}
+
+	return models, nil
+}
+
+// newRequest creates a request to the endpoint with the auth and extra headers set
+func (c *OpenAICompatibleProvider) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.config.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+	for key, value := range c.config.Headers {
+		httpReq.Header.Set(key, value)
+	}
+	return httpReq, nil
+}
+
+// perMillionTokens converts a per-token price string to dollars per million
+// tokens. Unknown or negative (variable) prices are reported as zero.
+func perMillionTokens(perToken string) float64 {
+	price, err := strconv.ParseFloat(perToken, 64)
+	if err != nil || price < 0 {
+		return 0
+	}
+	return price * 1_000_000
+}
+
+// buildMessages maps a ChatRequest to chat completion messages
+func (c *OpenAICompatibleProvider) buildMessages(req ChatRequest) []ChatCompletionMessage {
+	messages := make([]ChatCompletionMessage, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, ChatCompletionMessage{Role: "system", Content: req.System})
+	}
+	for _, msg := range req.Messages {
+		message := ChatCompletionMessage{Role: msg.Role, Content: msg.Content}
+		if msg.Role == RoleTool {
+			message.ToolCallID = msg.ToolCallID
+			message.Name = msg.ToolName
+		}
+		if len(msg.Images) > 0 {
+			message.Parts = []ChatContentPart{{Type: "text", Text: msg.Content}}
+			for _, image := range msg.Images {
+				message.Parts = append(message.Parts, ChatContentPart{Type: "image_url", ImageURL: &ChatImageURL{URL: image.dataURL()}})
+			}
+		}
+		for _, call := range msg.ToolCalls {
+			toolCall := ChatCompletionToolCall{ID: call.ID, Type: "function"}
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = call.Arguments
+			message.ToolCalls = append(message.ToolCalls, toolCall)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// toToolCalls converts the function calls of a completion
+func toToolCalls(calls []ChatCompletionToolCall) []ToolCall {
+	converted := make([]ToolCall, len(calls))
+	for i, call := range calls {
+		converted[i] = ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+	}
+	return converted
+}
+
+// SupportsVision reports whether a model accepts images
+func (c *OpenAICompatibleProvider) SupportsVision(model string) bool {
+	if c.config.Vision {
+		return true
+	}
+	for _, name := range c.config.VisionModels {
+		if strings.Contains(model, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsTools reports whether function calling is enabled for the endpoint
+func (c *OpenAICompatibleProvider) SupportsTools() bool {
+	return c.config.Tools
+}
+
+func (c *OpenAICompatibleProvider) GetName() string {
+	return c.config.Name
+}
+
+func (c *OpenAICompatibleProvider) GetDefaultModel() string {
+	return c.config.DefaultModel
+}
+
+func (c *OpenAICompatibleProvider) GetAvailableModels() []string {
+	return c.config.Models
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"sort"
+	"strings"
 
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
@@ -10,59 +12,250 @@ import (
 )
 
 type OpenAIProvider struct {
-	client *openai.Client
-	model  string
+	client       *openai.Client
+	defaultModel string
 }
 
 func NewOpenAIProvider(apiKey, model string) (*OpenAIProvider, error) {
 	if model == "" {
 		model = "gpt-5.1"
 	}
-	client := openai.NewClient(option.WithAPIKey(apiKey))
+	// Retries are handled by RetryProvider
+	client := openai.NewClient(option.WithAPIKey(apiKey), option.WithMaxRetries(0))
 	return &OpenAIProvider{
-		client: &client,
-		model:  model,
+		client:       &client,
+		defaultModel: model,
 	}, nil
 }
 
-func (o *OpenAIProvider) GetResponse(ctx context.Context, prompt string) (string, error) {
-	message, err := o.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model: shared.ChatModelGPT4o,
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.UserMessage(prompt),
-		},
-	})
+func (o *OpenAIProvider) GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	message, err := o.client.Chat.Completions.New(ctx, o.buildParams(req))
 	if err != nil {
-		// Provide more helpful error messages
-		errMsg := err.Error()
-		if errMsg == "429" || contains(errMsg, "rate limit") {
-			return "", fmt.Errorf("rate limited (HTTP 429): openai api received too many requests. Your account or API key may be under heavy load. Wait a few minutes and try again")
+		return ChatResponse{}, o.wrapError(err)
+	}
+	return o.toResponse(message.Choices, message.Usage)
+}
+
+// StreamResponse streams the completion, calling onDelta for each fragment
+func (o *OpenAIProvider) StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error) {
+	params := o.buildParams(req)
+	// Usage arrives in a final chunk without choices
+	params.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+
+	stream := o.client.Chat.Completions.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	// The accumulator assembles the content, tool calls and usage
+	var acc openai.ChatCompletionAccumulator
+	for stream.Next() {
+		chunk := stream.Current()
+		acc.AddChunk(chunk)
+		if len(chunk.Choices) == 0 {
+			continue
 		}
-		if errMsg == "503" || contains(errMsg, "service unavailable") {
-			return "", fmt.Errorf("service unavailable (HTTP 503): openai api is temporarily down. Check https://status.openai.com")
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			onDelta(delta)
 		}
-		if errMsg == "401" || contains(errMsg, "unauthorized") {
-			return "", fmt.Errorf("authentication failed (HTTP 401): Invalid API key. Check your OPENAI_API_KEY in .env")
+	}
+	if err := stream.Err(); err != nil {
+		return ChatResponse{}, o.wrapError(err)
+	}
+
+	return o.toResponse(acc.Choices, acc.Usage)
+}
+
+// toResponse converts the first choice of a completion
+func (o *OpenAIProvider) toResponse(choices []openai.ChatCompletionChoice, completionUsage openai.CompletionUsage) (ChatResponse, error) {
+	usage := openAIUsage(completionUsage)
+	if len(choices) == 0 {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	message := choices[0].Message
+	if len(message.ToolCalls) > 0 {
+		calls := make([]ToolCall, len(message.ToolCalls))
+		for i, call := range message.ToolCalls {
+			calls[i] = ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
 		}
-		if errMsg == "403" || contains(errMsg, "forbidden") {
-			return "", fmt.Errorf("permission denied (HTTP 403): Your API key may not have access to this model. Check your OpenAI account permissions")
+		return ChatResponse{Content: message.Content, ToolCalls: calls, Usage: usage}, nil
+	}
+
+	if message.Content == "" && choices[0].FinishReason == "content_filter" {
+		return ChatResponse{}, o.contentFilterError()
+	}
+	if message.Content == "" {
+		return ChatResponse{Content: "Sorry, I cannot respond to this.", Usage: usage}, nil
+	}
+
+	return ChatResponse{Content: message.Content, Usage: usage}, nil
+}
+
+// openAIUsage converts the token counts of a completion
+func openAIUsage(usage openai.CompletionUsage) Usage {
+	return Usage{
+		PromptTokens:     int(usage.PromptTokens),
+		CompletionTokens: int(usage.CompletionTokens),
+	}
+}
+
+// buildParams maps a ChatRequest to OpenAI chat completion parameters
+func (o *OpenAIProvider) buildParams(req ChatRequest) openai.ChatCompletionNewParams {
+	model := req.modelOr(o.defaultModel)
+	params := openai.ChatCompletionNewParams{
+		Model:    shared.ChatModel(model),
+		Messages: o.buildMessages(req),
+	}
+	for _, tool := range req.Tools {
+		params.Tools = append(params.Tools, openai.ChatCompletionToolParam{
+			Function: shared.FunctionDefinitionParam{
+				Name:        tool.Name,
+				Description: openai.String(tool.Description),
+				Parameters:  shared.FunctionParameters(tool.Parameters),
+			},
+		})
+	}
+
+	p := req.Params
+	if p.MaxTokens > 0 {
+		params.MaxCompletionTokens = openai.Int(int64(p.MaxTokens))
+	}
+	if p.Seed != nil {
+		params.Seed = openai.Int(*p.Seed)
+	}
+
+	// Reasoning models take an effort instead of sampling settings and stop sequences
+	if isOpenAIReasoningModel(model) {
+		if effort := openAIReasoningEffort(model, p.ReasoningEffort); effort != "" {
+			params.ReasoningEffort = shared.ReasoningEffort(effort)
 		}
-		if contains(errMsg, "timeout") || contains(errMsg, "connection") {
-			return "", fmt.Errorf("connection timeout: Network request failed. Check your internet connection and try again")
+		return params
+	}
+	if p.Temperature != nil {
+		params.Temperature = openai.Float(*p.Temperature)
+	}
+	if p.TopP != nil {
+		params.TopP = openai.Float(*p.TopP)
+	}
+	if len(p.Stop) > 0 {
+		// The API accepts at most 4 stop sequences
+		params.Stop = openai.ChatCompletionNewParamsStopUnion{OfStringArray: p.Stop[:min(len(p.Stop), 4)]}
+	}
+	return params
+}
+
+// isOpenAIReasoningModel reports whether a model is one of the o-series or
+// GPT-5 reasoning models
+func isOpenAIReasoningModel(model string) bool {
+	if strings.HasPrefix(model, "gpt-5") {
+		return !strings.Contains(model, "chat")
+	}
+	for _, prefix := range []string{"o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
 		}
-		return "", fmt.Errorf("failed to call openai api: %v", err)
 	}
+	return false
+}
 
-	if len(message.Choices) == 0 {
-		return "Sorry, I cannot respond to this.", nil
+// openAIReasoningEffort returns the effort to send to a reasoning model.
+// Only GPT-5 models accept "minimal", so the o-series get "low" instead.
+func openAIReasoningEffort(model, effort string) string {
+	if effort == ReasoningMinimal && !strings.HasPrefix(model, "gpt-5") {
+		return ReasoningLow
+	}
+	return effort
+}
+
+// wrapError converts an OpenAI client error into a ProviderError
+func (o *OpenAIProvider) wrapError(err error) error {
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		return newTransportError(o.GetName(), err)
+	}
+
+	providerErr := &ProviderError{
+		Kind:       classifyStatus(apiErr.StatusCode, apiErr.Message),
+		Provider:   o.GetName(),
+		StatusCode: apiErr.StatusCode,
+		Message:    apiErr.Message,
+	}
+	if apiErr.Response != nil {
+		providerErr.RetryAfter = parseRetryAfter(apiErr.Response.Header)
 	}
 
-	response := message.Choices[0].Message.Content
-	if response == "" {
-		return "Sorry, I cannot respond to this.", nil
+	switch apiErr.Code {
+	case "context_length_exceeded":
+		providerErr.Kind = ErrContextTooLong
+	case "content_filter", "content_policy_violation":
+		providerErr.Kind = ErrContentBlocked
+	case "model_not_found":
+		providerErr.Kind = ErrForbiddenModel
+	}
+	if providerErr.Kind == ErrAuth {
+		providerErr.Message += " (check OPENAI_API_KEY in .env)"
+	}
+	return providerErr
+}
+
+// contentFilterError reports a completion the content filter stopped
+func (o *OpenAIProvider) contentFilterError() error {
+	return &ProviderError{Kind: ErrContentBlocked, Provider: o.GetName(), Message: "response stopped by the content filter"}
+}
+
+// buildMessages maps a ChatRequest to OpenAI chat messages
+func (o *OpenAIProvider) buildMessages(req ChatRequest) []openai.ChatCompletionMessageParamUnion {
+	messages := make([]openai.ChatCompletionMessageParamUnion, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, openai.SystemMessage(req.System))
+	}
+	for _, msg := range req.Messages {
+		switch {
+		case msg.Role == RoleTool:
+			messages = append(messages, openai.ToolMessage(msg.Content, msg.ToolCallID))
+		case msg.Role == RoleAssistant && len(msg.ToolCalls) > 0:
+			assistant := openai.ChatCompletionAssistantMessageParam{}
+			if msg.Content != "" {
+				assistant.Content.OfString = openai.String(msg.Content)
+			}
+			for _, call := range msg.ToolCalls {
+				assistant.ToolCalls = append(assistant.ToolCalls, openai.ChatCompletionMessageToolCallParam{
+					ID: call.ID,
+					Function: openai.ChatCompletionMessageToolCallFunctionParam{
+						Name:      call.Name,
+						Arguments: call.Arguments,
+					},
+				})
+			}
+			messages = append(messages, openai.ChatCompletionMessageParamUnion{OfAssistant: &assistant})
+		case msg.Role == RoleAssistant:
+			messages = append(messages, openai.AssistantMessage(msg.Content))
+		case len(msg.Images) > 0:
+			parts := []openai.ChatCompletionContentPartUnionParam{openai.TextContentPart(msg.Content)}
+			for _, image := range msg.Images {
+				parts = append(parts, openai.ImageContentPart(openai.ChatCompletionContentPartImageImageURLParam{URL: image.dataURL()}))
+			}
+			messages = append(messages, openai.UserMessage(parts))
+		default:
+			messages = append(messages, openai.UserMessage(msg.Content))
+		}
 	}
+	return messages
+}
+
+// SupportsTools reports that OpenAI models can call tools
+func (o *OpenAIProvider) SupportsTools() bool {
+	return true
+}
 
-	return response, nil
+// SupportsVision reports whether a model accepts images; every current
+// OpenAI chat model does except GPT-3.5 and the mini o-series models
+func (o *OpenAIProvider) SupportsVision(model string) bool {
+	for _, prefix := range []string{"gpt-3.5", "o1-mini", "o3-mini"} {
+		if strings.HasPrefix(model, prefix) {
+			return false
+		}
+	}
+	return true
 }
 
 func (o *OpenAIProvider) GetName() string {
@@ -78,16 +271,44 @@ func (o *OpenAIProvider) GetAvailableModels() []string {
 	}
 }
 
-func (o *OpenAIProvider) SetModel(model string) {
-	o.model = model
+// ListModels fetches the chat models available to the API key
+func (o *OpenAIProvider) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	var models []ModelInfo
+	iter := o.client.Models.ListAutoPaging(ctx)
+	for iter.Next() {
+		if id := iter.Current().ID; isOpenAIChatModel(id) {
+			models = append(models, ModelInfo{ID: id})
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, o.wrapError(err)
+	}
+
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+	return models, nil
 }
 
-// Helper function
-func contains(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
+// isOpenAIChatModel filters out embedding, audio, image and moderation models
+func isOpenAIChatModel(id string) bool {
+	chat := false
+	for _, prefix := range []string{"gpt-", "chatgpt-", "o1", "o3", "o4"} {
+		if strings.HasPrefix(id, prefix) {
+			chat = true
+			break
 		}
 	}
-	return false
+	if !chat {
+		return false
+	}
+
+	for _, skip := range []string{"audio", "realtime", "tts", "transcribe", "image", "search", "instruct"} {
+		if strings.Contains(id, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *OpenAIProvider) GetDefaultModel() string {
+	return o.defaultModel
 }
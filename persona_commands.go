@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	// maxPersonaName bounds persona names, which are typed in commands
+	maxPersonaName = 32
+	// maxPersonaPrompt is the longest text Discord's modals accept
+	maxPersonaPrompt = 4000
+)
+
+// Actions of the persona modal. The custom ID carries the persona, e.g.
+// "persona:create:<name>" or "persona:edit:<id>".
+const (
+	PersonaCreate = "create"
+	PersonaEdit   = "edit"
+)
+
+// personaModalPrefix starts the custom ID of the persona modal
+const personaModalPrefix = "persona"
+
+// personaCreateCommand opens a modal to write the prompt of a new persona
+func (h *aiCommandHandler) personaCreateCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	name := strings.TrimSpace(data.Options.Find("name").String())
+	if name == "" {
+		return h.errorResponse("Give the persona a name.")
+	}
+
+	userDB, err := h.dbManager.GetUserDB(data.Event.SenderID().String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	if existing, err := userDB.GetPersona(name); err == nil {
+		return h.errorResponse(fmt.Sprintf("You already have a persona named %s. Change it with `/persona edit`.", existing.Name))
+	}
+
+	return h.personaModal(data, PersonaCreate+":"+name, "New persona: "+name, "")
+}
+
+// personaEditCommand opens a modal to change the prompt of a persona
+func (h *aiCommandHandler) personaEditCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userDB, err := h.dbManager.GetUserDB(data.Event.SenderID().String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	persona, denied := h.findPersona(userDB, data)
+	if denied != nil {
+		return denied
+	}
+
+	return h.personaModal(data, PersonaEdit+":"+strconv.FormatInt(persona.ID, 10), "Edit persona: "+persona.Name, persona.Prompt)
+}
+
+// personaListCommand lists the user's personas, marking the one in use
+func (h *aiCommandHandler) personaListCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	personas, err := userDB.ListPersonas()
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot list personas: %v", err))
+	}
+	active, ok, err := userDB.ActivePersona(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get your persona: %v", err))
+	}
+
+	var response strings.Builder
+	response.WriteString("**Your personas:**\n• **Kurosawa** — the default assistant")
+	if !ok {
+		response.WriteString(" **(in use)**")
+	}
+	response.WriteString("\n")
+	for _, persona := range personas {
+		fmt.Fprintf(&response, "• **%s** — “%s”", persona.Name, personaPreview(persona.Prompt))
+		if ok && persona.ID == active.ID {
+			response.WriteString(" **(in use)**")
+		}
+		response.WriteString("\n")
+	}
+	if len(personas) == 0 {
+		response.WriteString("\nCreate one with `/persona create`.")
+	} else {
+		response.WriteString("\nSwitch with `/persona use`, or go back to Kurosawa with `/persona reset`.")
+	}
+
+	return h.chatResponse(response.String())
+}
+
+// personaUseCommand makes the AI answer the user as one of their personas
+func (h *aiCommandHandler) personaUseCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	persona, denied := h.findPersona(userDB, data)
+	if denied != nil {
+		return denied
+	}
+	if err := userDB.SetActivePersona(userID, persona.ID); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot use persona: %v", err))
+	}
+
+	return h.chatResponse(fmt.Sprintf("Replies to you now come from **%s**, in every channel. Go back to Kurosawa with `/persona reset`.", persona.Name))
+}
+
+// personaResetCommand goes back to the default prompt
+func (h *aiCommandHandler) personaResetCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	if err := userDB.SetActivePersona(userID, 0); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot reset persona: %v", err))
+	}
+
+	return h.chatResponse("Replies to you now come from Kurosawa again. Your personas are kept; see them with `/persona list`.")
+}
+
+// findPersona looks up the persona named by the name option
+func (h *aiCommandHandler) findPersona(userDB *DBService, data cmdroute.CommandData) (Persona, *api.InteractionResponseData) {
+	name := strings.TrimSpace(data.Options.Find("name").String())
+	persona, err := userDB.GetPersona(name)
+	if err == sql.ErrNoRows {
+		return Persona{}, h.errorResponse(fmt.Sprintf("You have no persona named %s. See `/persona list`.", name))
+	}
+	if err != nil {
+		return Persona{}, h.errorResponse(fmt.Sprintf("Cannot get persona: %v", err))
+	}
+	return persona, nil
+}
+
+// personaModal opens the modal for writing a persona's prompt. Modals are an
+// interaction response of their own, so it is sent here and the router gets
+// nothing to send.
+func (h *aiCommandHandler) personaModal(data cmdroute.CommandData, action, title, prompt string) *api.InteractionResponseData {
+	response := api.InteractionResponse{
+		Type: api.ModalResponse,
+		Data: &api.InteractionResponseData{
+			CustomID: option.NewNullableString(personaModalPrefix + ":" + action),
+			Title:    option.NewNullableString(truncate(title, 42)),
+			Components: &discord.ContainerComponents{
+				&discord.ActionRowComponent{
+					&discord.TextInputComponent{
+						CustomID:     "prompt",
+						Style:        discord.TextInputParagraphStyle,
+						Label:        "System prompt",
+						LengthLimits: [2]int{1, maxPersonaPrompt},
+						Required:     true,
+						Value:        prompt,
+						Placeholder:  "You are a patient tutor who explains things step by step…",
+					},
+				},
+			},
+		},
+	}
+	if err := botState.RespondInteraction(data.Event.ID, data.Event.Token, response); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot open the persona editor: %v", err))
+	}
+	return nil
+}
+
+// parsePersonaModal decodes the custom ID of the persona modal into its
+// action and the persona's name or ID
+func parsePersonaModal(customID discord.ComponentID) (action, persona string, ok bool) {
+	fields := strings.SplitN(string(customID), ":", 3)
+	if len(fields) != 3 || fields[0] != personaModalPrefix {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// handlePersonaModal saves the prompt written in the persona modal
+func handlePersonaModal(e *discord.InteractionEvent, data *discord.ModalInteraction, action, persona string) *api.InteractionResponse {
+	prompt := strings.TrimSpace(modalValue(data, "prompt"))
+	if prompt == "" {
+		return replyNotice("The prompt is empty.")
+	}
+
+	userDB, err := dbManager.GetUserDB(e.SenderID().String())
+	if err != nil {
+		return replyNotice(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	switch action {
+	case PersonaCreate:
+		if _, err := userDB.GetPersona(persona); err == nil {
+			return replyNotice(fmt.Sprintf("You already have a persona named %s. Change it with `/persona edit`.", persona))
+		}
+		if _, err := userDB.CreatePersona(persona, prompt); err != nil {
+			return replyNotice(fmt.Sprintf("Cannot save persona: %v", err))
+		}
+		return replyNotice(fmt.Sprintf("Saved persona **%s**. Talk to it with `/persona use name:%s`.", persona, persona))
+
+	case PersonaEdit:
+		id, err := strconv.ParseInt(persona, 10, 64)
+		if err != nil {
+			return nil
+		}
+		saved, err := userDB.GetPersonaByID(id)
+		if err == sql.ErrNoRows {
+			return replyNotice("This persona no longer exists.")
+		}
+		if err == nil {
+			err = userDB.UpdatePersona(id, prompt)
+		}
+		if err != nil {
+			return replyNotice(fmt.Sprintf("Cannot save persona: %v", err))
+		}
+		return replyNotice(fmt.Sprintf("Saved persona **%s**.", saved.Name))
+	}
+	return nil
+}
+
+// modalValue returns the text typed in one of a modal's inputs
+func modalValue(data *discord.ModalInteraction, customID discord.ComponentID) string {
+	for _, container := range data.Components {
+		row, ok := container.(*discord.ActionRowComponent)
+		if !ok {
+			continue
+		}
+		for _, component := range *row {
+			if input, ok := component.(*discord.TextInputComponent); ok && input.CustomID == customID {
+				return input.Value
+			}
+		}
+	}
+	return ""
+}
+
+// personaPreview shortens a prompt to its first line for /persona list
+func personaPreview(prompt string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	return truncate(line, 100)
+}
@@ -1,6 +1,8 @@
 package main
 
 const (
+	// SystemPrompt is the default system prompt, used unless the user picked
+	// one of their personas with /persona
 	SystemPrompt = `You are Kurosawa, a helpful AI assistant. Respond to questions and requests accurately and concisely.
 
 GUIDELINES:
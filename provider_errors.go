@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Provider failure categories shared by every provider. Match them with
+// errors.Is; the *ProviderError carrying them has the details.
+var (
+	ErrRateLimited    = errors.New("rate limited")
+	ErrAuth           = errors.New("authentication failed")
+	ErrForbiddenModel = errors.New("model not permitted")
+	ErrBadRequest     = errors.New("bad request")
+	ErrUnavailable    = errors.New("service unavailable")
+	ErrTimeout        = errors.New("request timed out")
+	ErrContentBlocked = errors.New("content blocked")
+	ErrContextTooLong = errors.New("context too long")
+	// ErrNoVision is reported without calling the provider when a message
+	// has images and the model can't read them
+	ErrNoVision = errors.New("images not supported")
+)
+
+// errorKinds names the failure categories for configuration, e.g. RETRY_ON
+var errorKinds = map[string]error{
+	"rate_limited":     ErrRateLimited,
+	"unavailable":      ErrUnavailable,
+	"timeout":          ErrTimeout,
+	"auth":             ErrAuth,
+	"forbidden_model":  ErrForbiddenModel,
+	"bad_request":      ErrBadRequest,
+	"content_blocked":  ErrContentBlocked,
+	"context_too_long": ErrContextTooLong,
+}
+
+// parseErrorKinds parses a comma-separated list of errorKinds names
+func parseErrorKinds(value string) ([]error, error) {
+	var kinds []error
+	for _, name := range splitList(value) {
+		kind, ok := errorKinds[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown error kind %q", name)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// isErrorKind reports whether err falls in one of the categories
+func isErrorKind(err error, kinds []error) bool {
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProviderError describes a failed provider call
+type ProviderError struct {
+	// Kind is one of the Err* categories above
+	Kind     error
+	Provider string
+	// StatusCode is the HTTP status, or 0 when there was no response
+	StatusCode int
+	// RetryAfter is how long the provider asked us to wait, if it said so
+	RetryAfter time.Duration
+	// Message is the provider's own explanation
+	Message string
+	// Err is the underlying error, if any
+	Err error
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s: %v", strings.ToLower(e.Provider), e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+func (e *ProviderError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newHTTPError builds a ProviderError from an unsuccessful HTTP response
+// whose body has already been read
+func newHTTPError(provider string, resp *http.Response, body []byte) *ProviderError {
+	message := extractErrorMessage(body)
+	return &ProviderError{
+		Kind:       classifyStatus(resp.StatusCode, message),
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header),
+		Message:    message,
+	}
+}
+
+// newTransportError builds a ProviderError for a request that got no response
+func newTransportError(provider string, err error) *ProviderError {
+	kind := ErrUnavailable
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = ErrTimeout
+	}
+	return &ProviderError{Kind: kind, Provider: provider, Err: err}
+}
+
+// asProviderError returns err as a ProviderError attributed to provider.
+// Errors that aren't ProviderErrors yet are treated as transport failures.
+func asProviderError(provider string, err error) error {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		if providerErr.Provider == "" {
+			providerErr.Provider = provider
+		}
+		return err
+	}
+	return newTransportError(provider, err)
+}
+
+// classifyStatus maps an HTTP status and error message to a failure category
+func classifyStatus(status int, message string) error {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == http.StatusUnauthorized:
+		return ErrAuth
+	case status == http.StatusForbidden:
+		return ErrForbiddenModel
+	case status == http.StatusRequestEntityTooLarge || isContextTooLong(message):
+		return ErrContextTooLong
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrTimeout
+	case status >= 500:
+		return ErrUnavailable
+	default:
+		return ErrBadRequest
+	}
+}
+
+// isContextTooLong recognizes the ways providers report an oversized prompt
+func isContextTooLong(message string) bool {
+	message = strings.ToLower(message)
+	for _, hint := range []string{
+		"context length", "context_length", "context window", "maximum context",
+		"prompt is too long", "too many tokens", "input is too long",
+	} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractErrorMessage pulls the human readable message out of an error
+// body, accepting both {"error":{"message":...}} and {"message":...}
+func extractErrorMessage(body []byte) string {
+	var payload struct {
+		Message string          `json:"message"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return strings.TrimSpace(string(body))
+	}
+
+	var nested struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(payload.Error, &nested) == nil && nested.Message != "" {
+		return nested.Message
+	}
+
+	var plain string
+	if json.Unmarshal(payload.Error, &plain) == nil && plain != "" {
+		return plain
+	}
+
+	return payload.Message
+}
+
+// parseRetryAfter works out how long a provider asked us to wait. It reads
+// Retry-After (seconds or an HTTP date) and falls back to the x-ratelimit-*
+// headers of whichever limit is exhausted.
+func parseRetryAfter(header http.Header) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			if wait := time.Until(date); wait > 0 {
+				return wait
+			}
+		}
+	}
+
+	// OpenAI, Groq and others: x-ratelimit-reset-requests: 6m0s
+	var wait time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("X-Ratelimit-Remaining-"+limit) != "0" {
+			continue
+		}
+		if reset, err := time.ParseDuration(header.Get("X-Ratelimit-Reset-" + limit)); err == nil && reset > wait {
+			wait = reset
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	// OpenRouter: x-ratelimit-reset is a Unix timestamp in milliseconds
+	if header.Get("X-Ratelimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+			if wait := time.Until(time.UnixMilli(reset)); wait > 0 {
+				return wait
+			}
+		}
+	}
+	return 0
+}
+
+// UserFacingError turns a provider failure into a specific, actionable
+// message for Discord. Raw causes should be logged separately.
+func UserFacingError(err error) string {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) {
+		return "An error occurred while contacting the AI."
+	}
+	provider := providerErr.Provider
+
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		if providerErr.RetryAfter > 0 {
+			return fmt.Sprintf("%s is rate limiting requests right now. Try again in %s.", provider, formatWait(providerErr.RetryAfter))
+		}
+		return fmt.Sprintf("%s is rate limiting requests right now. Wait a minute and try again.", provider)
+	case errors.Is(err, ErrAuth):
+		return fmt.Sprintf("The bot's API key for %s was rejected. Please let an admin know.", provider)
+	case errors.Is(err, ErrForbiddenModel):
+		return fmt.Sprintf("The bot's %s account can't use this model. Pick another one with /model.", provider)
+	case errors.Is(err, ErrContextTooLong):
+		return "This conversation is too long for the selected model. Use /clearhistory or pick a model with a larger context via /model."
+	case errors.Is(err, ErrContentBlocked):
+		return fmt.Sprintf("%s declined to answer because its safety filters flagged the conversation. Try rephrasing.", provider)
+	case errors.Is(err, ErrTimeout):
+		return fmt.Sprintf("%s took too long to answer. Try again in a moment.", provider)
+	case errors.Is(err, ErrUnavailable):
+		return fmt.Sprintf("%s is temporarily unavailable. Try again later or switch with /provider.", provider)
+	case errors.Is(err, ErrNoVision):
+		return fmt.Sprintf("The %s model %s can't read images. Pick a model with vision via /model, or send the message without the image.", provider, providerErr.Message)
+	case errors.Is(err, ErrBadRequest):
+		if providerErr.Message != "" {
+			return fmt.Sprintf("%s rejected the request: %s", provider, truncate(providerErr.Message, 300))
+		}
+		return fmt.Sprintf("%s rejected the request. Check your model with /model.", provider)
+	default:
+		return "An error occurred while contacting the AI."
+	}
+}
+
+// formatWait renders a wait time for users, rounded up to whole seconds
+func formatWait(d time.Duration) string {
+	return (d + time.Second - 1).Truncate(time.Second).String()
+}
+
+// truncate shortens s to at most max bytes without splitting a UTF-8
+// character, marking the cut with an ellipsis
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max] + "…"
+}
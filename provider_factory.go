@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 type providerConfig struct {
@@ -25,9 +28,10 @@ func NewProviderFactory() (*ProviderFactory, error) {
 		{
 			name:        "gemini",
 			apiKeyEnv:   "GEMINI_API_KEY",
-			modelEnvKey: "",
-			constructor: func(apiKey, _ string) (AIProvider, error) {
-				return NewGeminiProvider(apiKey)
+			modelEnvKey: "GEMINI_DEFAULT_MODEL",
+			constructor: func(apiKey, model string) (AIProvider, error) {
+				provider, err := NewGeminiProvider(apiKey, model)
+				return AIProvider(provider), err
 			},
 		},
 		{
@@ -44,7 +48,7 @@ func NewProviderFactory() (*ProviderFactory, error) {
 			apiKeyEnv:   "MISTRAL_API_KEY",
 			modelEnvKey: "MISTRAL_DEFAULT_MODEL",
 			constructor: func(apiKey, model string) (AIProvider, error) {
-				provider, err := NewMistralProvider(apiKey, model)
+				provider, err := NewMistralProvider(apiKey, model, os.Getenv("MISTRAL_BASE_URL"))
 				return AIProvider(provider), err
 			},
 		},
@@ -53,7 +57,17 @@ func NewProviderFactory() (*ProviderFactory, error) {
 			apiKeyEnv:   "OPENROUTER_API_KEY",
 			modelEnvKey: "OPENROUTER_DEFAULT_MODEL",
 			constructor: func(apiKey, model string) (AIProvider, error) {
-				provider, err := NewOpenRouterProvider(apiKey, model)
+				provider, err := NewOpenRouterProvider(apiKey, model, os.Getenv("OPENROUTER_BASE_URL"))
+				return AIProvider(provider), err
+			},
+		},
+		{
+			name:        "anthropic",
+			apiKeyEnv:   "ANTHROPIC_API_KEY",
+			modelEnvKey: "ANTHROPIC_DEFAULT_MODEL",
+			constructor: func(apiKey, model string) (AIProvider, error) {
+				maxTokens, _ := strconv.Atoi(os.Getenv("ANTHROPIC_MAX_TOKENS"))
+				provider, err := NewAnthropicProvider(apiKey, model, maxTokens)
 				return AIProvider(provider), err
 			},
 		},
@@ -65,10 +79,26 @@ func NewProviderFactory() (*ProviderFactory, error) {
 		}
 	}
 
+	builtin := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		builtin[cfg.name] = true
+	}
+	for _, name := range splitList(os.Getenv("OPENAI_COMPATIBLE_PROVIDERS")) {
+		name = strings.ToLower(name)
+		if builtin[name] {
+			fmt.Printf("Warning: %s: name is already used by a built-in provider\n", name)
+			continue
+		}
+		if err := factory.registerCompatibleProvider(name); err != nil {
+			fmt.Printf("Warning: %s: %v\n", name, err)
+		}
+	}
+
 	if len(factory.providers) == 0 {
 		return nil, fmt.Errorf(
 			"No AI providers configured. Please set at least ONE API key in .env file: " +
-				"GEMINI_API_KEY, OPENAI_API_KEY, MISTRAL_API_KEY, or OPENROUTER_API_KEY",
+				"GEMINI_API_KEY, OPENAI_API_KEY, MISTRAL_API_KEY, OPENROUTER_API_KEY, or ANTHROPIC_API_KEY, " +
+				"or declare an endpoint in OPENAI_COMPATIBLE_PROVIDERS",
 		)
 	}
 
@@ -88,11 +118,78 @@ func (f *ProviderFactory) registerProvider(cfg providerConfig) error {
 		return fmt.Errorf("failed to initialize: %w", err)
 	}
 
-	f.providers[cfg.name] = provider
+	policy, err := retryPolicyFromEnv(envPrefix(cfg.name))
+	if err != nil {
+		return err
+	}
+
+	f.providers[cfg.name] = NewRetryProvider(provider, policy)
 	fmt.Printf("Loaded %s provider\n", cfg.name)
 	return nil
 }
 
+// registerCompatibleProvider registers a user-declared OpenAI-compatible
+// endpoint. Its settings are read from <NAME>_BASE_URL, <NAME>_API_KEY,
+// <NAME>_DEFAULT_MODEL, <NAME>_MODELS and <NAME>_REASONING_MODELS
+// (comma-separated). Like the built-in providers it honors
+// <NAME>_MAX_ATTEMPTS and <NAME>_RETRY_ON.
+func (f *ProviderFactory) registerCompatibleProvider(name string) error {
+	prefix := envPrefix(name)
+
+	baseURL := os.Getenv(prefix + "_BASE_URL")
+	if baseURL == "" {
+		return fmt.Errorf("base URL not set (%s_BASE_URL)", prefix)
+	}
+
+	provider, err := NewOpenAICompatibleProvider(OpenAICompatibleConfig{
+		Name:         name,
+		BaseURL:      baseURL,
+		APIKey:       os.Getenv(prefix + "_API_KEY"),
+		APIKeyEnv:    prefix + "_API_KEY",
+		DefaultModel: os.Getenv(prefix + "_DEFAULT_MODEL"),
+		Models:       splitList(os.Getenv(prefix + "_MODELS")),
+		StreamUsage:  true,
+		Tools:        os.Getenv(prefix+"_TOOLS") == "true",
+		Vision:       os.Getenv(prefix+"_VISION") == "true",
+		// Reasoning models other than OpenAI's, e.g. "deepseek-r1,qwq"
+		ReasoningModels: splitList(os.Getenv(prefix + "_REASONING_MODELS")),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+
+	policy, err := retryPolicyFromEnv(prefix)
+	if err != nil {
+		return err
+	}
+
+	f.providers[name] = NewRetryProvider(provider, policy)
+	fmt.Printf("Loaded %s provider (%s)\n", name, baseURL)
+	return nil
+}
+
+// envPrefix turns a provider name into an environment variable prefix,
+// e.g. "lm-studio" becomes "LM_STUDIO"
+func envPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, name)
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func (f *ProviderFactory) GetProviders() map[string]AIProvider {
 	return f.providers
 }
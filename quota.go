@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota rule scopes. Per limit, a user rule beats the most generous rule of
+// the user's roles, which beats the default rule. Guild rules cap the
+// combined usage of every member.
+const (
+	QuotaScopeUser    = "user"
+	QuotaScopeRole    = "role"
+	QuotaScopeDefault = "default"
+	QuotaScopeGuild   = "guild"
+)
+
+// DefaultQuotaWarnPercent is how full an allowance gets before users are warned
+const DefaultQuotaWarnPercent = 80
+
+// quotaLimit is one configurable allowance, e.g. daily_messages
+type quotaLimit struct {
+	Name   string
+	Period string // "day" or "month"
+	Metric string // "messages", "tokens" or "cost"
+}
+
+// quotaLimits lists every limit that can be set, in display order
+var quotaLimits = []quotaLimit{
+	{"daily_messages", "day", "messages"},
+	{"daily_tokens", "day", "tokens"},
+	{"daily_cost", "day", "cost"},
+	{"monthly_messages", "month", "messages"},
+	{"monthly_tokens", "month", "tokens"},
+	{"monthly_cost", "month", "cost"},
+}
+
+// QuotaLimits maps limit names to allowances. A missing limit is unlimited.
+type QuotaLimits map[string]float64
+
+// quotaPeriodUsage is what a user or guild consumed in a period
+type quotaPeriodUsage struct {
+	Messages float64
+	Tokens   float64
+	Cost     float64
+}
+
+func (u quotaPeriodUsage) metric(name string) float64 {
+	switch name {
+	case "messages":
+		return u.Messages
+	case "tokens":
+		return u.Tokens
+	default:
+		return u.Cost
+	}
+}
+
+// QuotaStatus compares a user's usage with their allowances
+type QuotaStatus struct {
+	// Exceeded explains why the request is refused; empty when it may go ahead
+	Exceeded string
+	// Warning is set when the user is close to one of their limits
+	Warning string
+}
+
+// QuotaService enforces message, token and cost allowances. It keeps a
+// ledger of every AI response in a database shared by all users, so that
+// clearing or deleting a user's own data doesn't reset their usage.
+type QuotaService struct {
+	db          *sql.DB
+	defaults    QuotaLimits
+	guild       QuotaLimits
+	warnPercent float64
+}
+
+// NewQuotaService opens the quota database. defaults and guild are the
+// limits from the environment; rules set with /quota take precedence.
+func NewQuotaService(path string, defaults, guild QuotaLimits, warnPercent float64) (*QuotaService, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	if warnPercent <= 0 || warnPercent > 100 {
+		warnPercent = DefaultQuotaWarnPercent
+	}
+
+	q := &QuotaService{db: db, defaults: defaults, guild: guild, warnPercent: warnPercent}
+	if err := q.createTables(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// quotaServiceFromEnv reads QUOTA_DEFAULT, QUOTA_GUILD and QUOTA_WARN_PERCENT
+func quotaServiceFromEnv(dataDir string) (*QuotaService, error) {
+	defaults, err := parseQuotaLimits(os.Getenv("QUOTA_DEFAULT"))
+	if err != nil {
+		return nil, fmt.Errorf("QUOTA_DEFAULT: %w", err)
+	}
+	guild, err := parseQuotaLimits(os.Getenv("QUOTA_GUILD"))
+	if err != nil {
+		return nil, fmt.Errorf("QUOTA_GUILD: %w", err)
+	}
+	var warnPercent float64
+	if value := strings.TrimSpace(os.Getenv("QUOTA_WARN_PERCENT")); value != "" {
+		warnPercent, err = strconv.ParseFloat(value, 64)
+		if err != nil || warnPercent <= 0 || warnPercent > 100 {
+			return nil, fmt.Errorf("QUOTA_WARN_PERCENT must be a number above 0 and up to 100, e.g. 80")
+		}
+	}
+
+	return NewQuotaService(filepath.Join(dataDir, "quota.db"), defaults, guild, warnPercent)
+}
+
+// parseQuotaLimits parses "daily_messages=50,monthly_cost=5"
+func parseQuotaLimits(value string) (QuotaLimits, error) {
+	limits := QuotaLimits{}
+	for _, entry := range splitList(value) {
+		name, amount, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !isQuotaLimit(name) {
+			return nil, fmt.Errorf("invalid limit %q", entry)
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid amount in %q", entry)
+		}
+		limits[name] = parsed
+	}
+	return limits, nil
+}
+
+func isQuotaLimit(name string) bool {
+	return slices.ContainsFunc(quotaLimits, func(l quotaLimit) bool { return l.Name == name })
+}
+
+func (q *QuotaService) createTables() error {
+	ledgerQuery := `
+	CREATE TABLE IF NOT EXISTS quota_usage (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL,
+		guild_id TEXT NOT NULL DEFAULT '',
+		tokens INTEGER NOT NULL DEFAULT 0,
+		cost REAL NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS quota_usage_user ON quota_usage (user_id, created_at);
+	CREATE INDEX IF NOT EXISTS quota_usage_guild ON quota_usage (guild_id, created_at);`
+	if _, err := q.db.Exec(ledgerQuery); err != nil {
+		return err
+	}
+
+	// reply is 0 for internal calls, such as titles, whose tokens and cost
+	// count but which aren't messages the user sent
+	if _, err := q.db.Exec(`ALTER TABLE quota_usage ADD COLUMN reply INTEGER NOT NULL DEFAULT 1`); err != nil {
+		if !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+
+	// scope_id is the user or role ID, or '' for the default and guild scopes
+	rulesQuery := `
+	CREATE TABLE IF NOT EXISTS quota_rules (
+		scope TEXT NOT NULL,
+		scope_id TEXT NOT NULL DEFAULT '',
+		limit_name TEXT NOT NULL,
+		amount REAL NOT NULL,
+		PRIMARY KEY (scope, scope_id, limit_name)
+	);`
+	_, err := q.db.Exec(rulesQuery)
+	return err
+}
+
+// Record adds a response to the ledger. reply is false for calls the user
+// didn't ask for, which count toward tokens and cost but not messages.
+func (q *QuotaService) Record(user ChatUser, usage UsageRecord, reply bool) error {
+	query := `INSERT INTO quota_usage (user_id, guild_id, tokens, cost, created_at, reply) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := q.db.Exec(query, user.ID, user.GuildID, usage.PromptTokens+usage.CompletionTokens, usage.Cost, time.Now().Unix(), reply)
+	return err
+}
+
+// Check reports whether the user may make another request
+func (q *QuotaService) Check(user ChatUser) (QuotaStatus, error) {
+	limits, err := q.Limits(user)
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+
+	var status QuotaStatus
+	usage := map[string]quotaPeriodUsage{}
+	for _, limit := range quotaLimits {
+		allowance, ok := limits[limit.Name]
+		if !ok {
+			continue
+		}
+		used, ok := usage[limit.Period]
+		if !ok {
+			if used, err = q.usage("user_id", user.ID, limit.Period); err != nil {
+				return QuotaStatus{}, err
+			}
+			usage[limit.Period] = used
+		}
+
+		amount := used.metric(limit.Metric)
+		if amount >= allowance {
+			status.Exceeded = fmt.Sprintf("You've reached your %s limit of %s. It resets in %s.",
+				periodAdjective(limit.Period), formatQuotaAmount(limit.Metric, allowance), formatWait(untilPeriodEnd(limit.Period)))
+			return status, nil
+		}
+		if status.Warning == "" && amount >= allowance*q.warnPercent/100 {
+			status.Warning = fmt.Sprintf("You've used %s of your %s limit of %s.",
+				formatQuotaAmount(limit.Metric, amount), periodAdjective(limit.Period), formatQuotaAmount(limit.Metric, allowance))
+		}
+	}
+
+	if user.GuildID == "" {
+		return status, nil
+	}
+
+	guildLimits, err := q.Rules(QuotaScopeGuild, "")
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	for _, limit := range quotaLimits {
+		allowance, ok := guildLimits[limit.Name]
+		if !ok || allowance < 0 {
+			continue
+		}
+		used, err := q.usage("guild_id", user.GuildID, limit.Period)
+		if err != nil {
+			return QuotaStatus{}, err
+		}
+		if used.metric(limit.Metric) >= allowance {
+			status.Exceeded = fmt.Sprintf("This server has used up its %s AI allowance of %s. It resets in %s.",
+				periodAdjective(limit.Period), formatQuotaAmount(limit.Metric, allowance), formatWait(untilPeriodEnd(limit.Period)))
+			return status, nil
+		}
+	}
+
+	return status, nil
+}
+
+// Limits returns the effective allowances of a user
+func (q *QuotaService) Limits(user ChatUser) (QuotaLimits, error) {
+	limits, err := q.Rules(QuotaScopeDefault, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// The most generous role wins for each limit
+	roleLimits := QuotaLimits{}
+	for _, roleID := range user.RoleIDs {
+		rules, err := q.Rules(QuotaScopeRole, roleID)
+		if err != nil {
+			return nil, err
+		}
+		for name, amount := range rules {
+			if current, ok := roleLimits[name]; !ok || moreGenerous(amount, current) {
+				roleLimits[name] = amount
+			}
+		}
+	}
+	for name, amount := range roleLimits {
+		limits[name] = amount
+	}
+
+	userRules, err := q.Rules(QuotaScopeUser, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for name, amount := range userRules {
+		limits[name] = amount
+	}
+
+	// Negative amounts mean unlimited
+	for name, amount := range limits {
+		if amount < 0 {
+			delete(limits, name)
+		}
+	}
+
+	return limits, nil
+}
+
+// moreGenerous reports whether allowance a is larger than b, where negative
+// allowances are unlimited
+func moreGenerous(a, b float64) bool {
+	if b < 0 {
+		return false
+	}
+	return a < 0 || a > b
+}
+
+// Rules returns the limits set for one scope, negative meaning unlimited. The
+// default and guild scopes start from the environment configuration.
+func (q *QuotaService) Rules(scope, scopeID string) (QuotaLimits, error) {
+	rules := QuotaLimits{}
+	switch scope {
+	case QuotaScopeDefault:
+		for name, amount := range q.defaults {
+			rules[name] = amount
+		}
+	case QuotaScopeGuild:
+		for name, amount := range q.guild {
+			rules[name] = amount
+		}
+	}
+
+	rows, err := q.db.Query(`SELECT limit_name, amount FROM quota_rules WHERE scope = ? AND scope_id = ?`, scope, scopeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var amount float64
+		if err := rows.Scan(&name, &amount); err != nil {
+			return nil, err
+		}
+		rules[name] = amount
+	}
+	return rules, rows.Err()
+}
+
+// SetRule sets a limit for a scope, or removes it when amount is nil. A
+// negative amount makes the limit unlimited for that scope.
+func (q *QuotaService) SetRule(scope, scopeID, limitName string, amount *float64) error {
+	if amount == nil {
+		_, err := q.db.Exec(`DELETE FROM quota_rules WHERE scope = ? AND scope_id = ? AND limit_name = ?`, scope, scopeID, limitName)
+		return err
+	}
+
+	query := `INSERT INTO quota_rules (scope, scope_id, limit_name, amount) VALUES (?, ?, ?, ?)
+	         ON CONFLICT(scope, scope_id, limit_name) DO UPDATE SET amount = ?`
+	_, err := q.db.Exec(query, scope, scopeID, limitName, *amount, *amount)
+	return err
+}
+
+// UserUsage returns what a user consumed in the current period
+func (q *QuotaService) UserUsage(userID, period string) (quotaPeriodUsage, error) {
+	return q.usage("user_id", userID, period)
+}
+
+// GuildUsage returns what a guild consumed in the current period
+func (q *QuotaService) GuildUsage(guildID, period string) (quotaPeriodUsage, error) {
+	return q.usage("guild_id", guildID, period)
+}
+
+// usage sums the ledger for a user or guild since the start of the period
+func (q *QuotaService) usage(column, id, period string) (quotaPeriodUsage, error) {
+	var used quotaPeriodUsage
+	query := `SELECT COALESCE(SUM(reply), 0), COALESCE(SUM(tokens), 0), COALESCE(SUM(cost), 0) FROM quota_usage WHERE ` + column + ` = ? AND created_at >= ?`
+	err := q.db.QueryRow(query, id, periodStart(period).Unix()).Scan(&used.Messages, &used.Tokens, &used.Cost)
+	return used, err
+}
+
+func (q *QuotaService) Close() {
+	q.db.Close()
+}
+
+// periodStart returns the start of the current day or month in UTC
+func periodStart(period string) time.Time {
+	now := time.Now().UTC()
+	if period == "month" {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// untilPeriodEnd returns how long until the current day or month is over
+func untilPeriodEnd(period string) time.Duration {
+	start := periodStart(period)
+	if period == "month" {
+		return time.Until(start.AddDate(0, 1, 0))
+	}
+	return time.Until(start.AddDate(0, 0, 1))
+}
+
+func periodAdjective(period string) string {
+	if period == "month" {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// formatQuotaAmount renders an amount of a metric, e.g. "50 messages" or "$1.50"
+func formatQuotaAmount(metric string, amount float64) string {
+	switch metric {
+	case "messages":
+		return fmt.Sprintf("%.0f messages", amount)
+	case "tokens":
+		return formatTokenCount(int(amount)) + " tokens"
+	default:
+		return fmt.Sprintf("$%.2f", amount)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// quotaCommandHandler implements the admin-only /quota command
+type quotaCommandHandler struct {
+	quotas *QuotaService
+}
+
+// RegisterQuotaCommands registers /quota and its subcommands
+func RegisterQuotaCommands(router *cmdroute.Router, quotas *QuotaService) {
+	handler := &quotaCommandHandler{quotas: quotas}
+
+	router.Sub("quota", func(r *cmdroute.Router) {
+		r.AddFunc("view", handler.viewCommand)
+		r.AddFunc("user", handler.setCommand(QuotaScopeUser))
+		r.AddFunc("role", handler.setCommand(QuotaScopeRole))
+		r.AddFunc("default", handler.setCommand(QuotaScopeDefault))
+		r.AddFunc("guild", handler.setCommand(QuotaScopeGuild))
+	})
+}
+
+// viewCommand shows the rules in place, or a user's allowances and usage
+func (h *quotaCommandHandler) viewCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	if denied := h.checkAdmin(data); denied != nil {
+		return denied
+	}
+
+	userID, err := data.Options.Find("user").SnowflakeValue()
+	if err != nil || !userID.IsValid() {
+		return h.viewRules(data.Event.GuildID)
+	}
+	return h.viewUser(data.Event.GuildID, discord.UserID(userID))
+}
+
+// viewRules lists the default, guild and role rules
+func (h *quotaCommandHandler) viewRules(guildID discord.GuildID) *api.InteractionResponseData {
+	response := "**Quotas**\n"
+
+	for _, scope := range []string{QuotaScopeDefault, QuotaScopeGuild} {
+		rules, err := h.quotas.Rules(scope, "")
+		if err != nil {
+			return h.response("Error: " + err.Error())
+		}
+		title := "Default (everyone)"
+		if scope == QuotaScopeGuild {
+			title = "Server total"
+		}
+		response += fmt.Sprintf("%s: %s\n", title, formatQuotaLimits(rules))
+	}
+
+	roles, err := botState.Roles(guildID)
+	if err != nil {
+		return h.response("Error: " + err.Error())
+	}
+	for _, role := range roles {
+		rules, err := h.quotas.Rules(QuotaScopeRole, role.ID.String())
+		if err != nil {
+			return h.response("Error: " + err.Error())
+		}
+		if len(rules) > 0 {
+			response += fmt.Sprintf("%s: %s\n", role.Mention(), formatQuotaLimits(rules))
+		}
+	}
+
+	used, err := h.quotas.GuildUsage(guildID.String(), "month")
+	if err == nil {
+		response += fmt.Sprintf("\nServer usage this month: %s", formatQuotaUsage(used))
+	}
+
+	return h.response(response)
+}
+
+// viewUser shows a user's effective allowances and what they used of them
+func (h *quotaCommandHandler) viewUser(guildID discord.GuildID, userID discord.UserID) *api.InteractionResponseData {
+	user := ChatUser{ID: userID.String(), GuildID: guildID.String()}
+	if member, err := botState.Member(guildID, userID); err == nil {
+		for _, roleID := range member.RoleIDs {
+			user.RoleIDs = append(user.RoleIDs, roleID.String())
+		}
+	}
+
+	limits, err := h.quotas.Limits(user)
+	if err != nil {
+		return h.response("Error: " + err.Error())
+	}
+	overrides, err := h.quotas.Rules(QuotaScopeUser, user.ID)
+	if err != nil {
+		return h.response("Error: " + err.Error())
+	}
+	today, err := h.quotas.UserUsage(user.ID, "day")
+	if err != nil {
+		return h.response("Error: " + err.Error())
+	}
+	month, err := h.quotas.UserUsage(user.ID, "month")
+	if err != nil {
+		return h.response("Error: " + err.Error())
+	}
+
+	response := fmt.Sprintf("**Quota for %s**\n", userID.Mention())
+	response += fmt.Sprintf("Allowances: %s\n", formatQuotaLimits(limits))
+	if len(overrides) > 0 {
+		response += fmt.Sprintf("User overrides: %s\n", formatQuotaLimits(overrides))
+	}
+	response += fmt.Sprintf("Today: %s\n", formatQuotaUsage(today))
+	response += fmt.Sprintf("This month: %s\n", formatQuotaUsage(month))
+
+	return h.response(response)
+}
+
+// setCommand returns the handler that sets or removes a limit in a scope
+func (h *quotaCommandHandler) setCommand(scope string) cmdroute.CommandHandlerFunc {
+	return func(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+		if denied := h.checkAdmin(data); denied != nil {
+			return denied
+		}
+
+		var scopeID, target string
+		switch scope {
+		case QuotaScopeUser:
+			id, err := data.Options.Find("user").SnowflakeValue()
+			if err != nil {
+				return h.response("Error: a user is required")
+			}
+			scopeID, target = id.String(), discord.UserID(id).Mention()
+		case QuotaScopeRole:
+			id, err := data.Options.Find("role").SnowflakeValue()
+			if err != nil {
+				return h.response("Error: a role is required")
+			}
+			scopeID, target = id.String(), discord.RoleID(id).Mention()
+		case QuotaScopeDefault:
+			target = "everyone"
+		case QuotaScopeGuild:
+			target = "the server total"
+		}
+
+		limitName := data.Options.Find("limit").String()
+		if !isQuotaLimit(limitName) {
+			return h.response(fmt.Sprintf("Error: unknown limit '%s'", limitName))
+		}
+
+		// Without a value the rule is removed
+		var amount *float64
+		if value, err := data.Options.Find("value").FloatValue(); err == nil {
+			amount = &value
+		}
+
+		if err := h.quotas.SetRule(scope, scopeID, limitName, amount); err != nil {
+			return h.response("Error: " + err.Error())
+		}
+
+		switch {
+		case amount == nil:
+			return h.response(fmt.Sprintf("Removed the %s rule for %s.", limitName, target))
+		case *amount < 0:
+			return h.response(fmt.Sprintf("%s is now unlimited for %s.", limitName, target))
+		default:
+			return h.response(fmt.Sprintf("%s set to %s for %s.", limitName, formatQuotaAmount(quotaMetric(limitName), *amount), target))
+		}
+	}
+}
+
+// checkAdmin refuses members without the Manage Server permission
+func (h *quotaCommandHandler) checkAdmin(data cmdroute.CommandData) *api.InteractionResponseData {
+	p, err := botState.Permissions(data.Event.ChannelID, data.Event.SenderID())
+	if err != nil {
+		return h.response("Error checking permissions.")
+	}
+	if !p.Has(discord.PermissionManageGuild) && !p.Has(discord.PermissionAdministrator) {
+		return h.response("You don't have permission to use this command.")
+	}
+	return nil
+}
+
+func (h *quotaCommandHandler) response(content string) *api.InteractionResponseData {
+	return &api.InteractionResponseData{
+		Content:         option.NewNullableString(truncate(content, MaxMessageLength)),
+		Flags:           discord.EphemeralMessage,
+		AllowedMentions: &api.AllowedMentions{},
+	}
+}
+
+// quotaMetric returns the metric a limit measures
+func quotaMetric(limitName string) string {
+	for _, limit := range quotaLimits {
+		if limit.Name == limitName {
+			return limit.Metric
+		}
+	}
+	return ""
+}
+
+// formatQuotaLimits renders limits in display order, e.g. "daily_messages 50, monthly_cost $5.00"
+func formatQuotaLimits(limits QuotaLimits) string {
+	var parts []string
+	for _, limit := range quotaLimits {
+		amount, ok := limits[limit.Name]
+		if !ok {
+			continue
+		}
+		if amount < 0 {
+			parts = append(parts, limit.Name+" unlimited")
+		} else {
+			parts = append(parts, fmt.Sprintf("%s %s", limit.Name, formatQuotaAmount(limit.Metric, amount)))
+		}
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatQuotaUsage renders what was used in a period
+func formatQuotaUsage(used quotaPeriodUsage) string {
+	return fmt.Sprintf("%s, %s, %s",
+		formatQuotaAmount("messages", used.Messages),
+		formatQuotaAmount("tokens", used.Tokens),
+		formatQuotaAmount("cost", used.Cost))
+}
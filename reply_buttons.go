@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// Actions of the buttons under AI replies
+const (
+	ReplyRegenerate = "regenerate"
+	ReplyContinue   = "continue"
+	ReplyDelete     = "delete"
+	ReplyLike       = "like"
+	ReplyDislike    = "dislike"
+)
+
+// replyButtonPrefix starts the custom ID of the reply buttons
+const replyButtonPrefix = "reply"
+
+// ReplyRef identifies the reply a button belongs to. It is kept in the
+// button's custom ID, e.g. "reply:like:<user>:<thread>:<message>".
+type ReplyRef struct {
+	// UserID is who the reply answered; only they can use its buttons
+	UserID string
+	// ThreadID is set for replies in a thread, whose history is shared
+	ThreadID string
+	// MessageID is the assistant turn in the history
+	MessageID int64
+}
+
+// newReplyRef refers to a reply to user saved as messageID
+func newReplyRef(user ChatUser, messageID int64) ReplyRef {
+	return ReplyRef{UserID: user.ID, ThreadID: user.ThreadID, MessageID: messageID}
+}
+
+// customID encodes a button action on the reply
+func (r ReplyRef) customID(action string) discord.ComponentID {
+	return discord.ComponentID(strings.Join([]string{replyButtonPrefix, action, r.UserID, r.ThreadID, strconv.FormatInt(r.MessageID, 10)}, ":"))
+}
+
+// parseReplyButton decodes the custom ID of a reply button
+func parseReplyButton(customID discord.ComponentID) (string, ReplyRef, bool) {
+	fields := strings.Split(string(customID), ":")
+	if len(fields) != 5 || fields[0] != replyButtonPrefix {
+		return "", ReplyRef{}, false
+	}
+	messageID, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return "", ReplyRef{}, false
+	}
+	return fields[1], ReplyRef{UserID: fields[2], ThreadID: fields[3], MessageID: messageID}, true
+}
+
+// replyButtons is the action row under a reply. feedback, 1 or -1, marks
+// the rating already given. Replies that weren't saved, such as notices, get
+// no buttons.
+func replyButtons(ref ReplyRef, feedback int) discord.ContainerComponents {
+	if ref.MessageID == 0 {
+		return nil
+	}
+
+	like, dislike := discord.SecondaryButtonStyle(), discord.SecondaryButtonStyle()
+	switch feedback {
+	case 1:
+		like = discord.SuccessButtonStyle()
+	case -1:
+		dislike = discord.DangerButtonStyle()
+	}
+
+	return discord.ContainerComponents{
+		&discord.ActionRowComponent{
+			&discord.ButtonComponent{
+				Label:    "Regenerate",
+				Emoji:    &discord.ComponentEmoji{Name: "🔄"},
+				Style:    discord.SecondaryButtonStyle(),
+				CustomID: ref.customID(ReplyRegenerate),
+			},
+			&discord.ButtonComponent{
+				Label:    "Continue",
+				Emoji:    &discord.ComponentEmoji{Name: "➡️"},
+				Style:    discord.SecondaryButtonStyle(),
+				CustomID: ref.customID(ReplyContinue),
+			},
+			&discord.ButtonComponent{
+				Label:    "Delete",
+				Emoji:    &discord.ComponentEmoji{Name: "🗑️"},
+				Style:    discord.SecondaryButtonStyle(),
+				CustomID: ref.customID(ReplyDelete),
+			},
+			&discord.ButtonComponent{
+				Emoji:    &discord.ComponentEmoji{Name: "👍"},
+				Style:    like,
+				CustomID: ref.customID(ReplyLike),
+			},
+			&discord.ButtonComponent{
+				Emoji:    &discord.ComponentEmoji{Name: "👎"},
+				Style:    dislike,
+				CustomID: ref.customID(ReplyDislike),
+			},
+		},
+	}
+}
+
+// saveReplyMessages remembers which Discord messages show a reply, so that
+// its buttons can replace or delete all of them
+func saveReplyMessages(user ChatUser, messageID int64, messages []discord.MessageID) {
+	if messageID == 0 || len(messages) == 0 {
+		return
+	}
+	db, err := mlService.HistoryDB(user)
+	if err == nil {
+		ids := make([]string, len(messages))
+		for i, id := range messages {
+			ids[i] = id.String()
+		}
+		err = db.SetReplyMessages(messageID, ids)
+	}
+	if err != nil {
+		log.Printf("Error saving reply messages: %v", err)
+	}
+}
+
+// handleReplyButton handles a click on the buttons under a reply
+func handleReplyButton(bot *state.State, e *discord.InteractionEvent, action string, ref ReplyRef) *api.InteractionResponse {
+	if e.SenderID().String() != ref.UserID {
+		return replyNotice(fmt.Sprintf("Only <@%s> can use the buttons of this reply.", ref.UserID))
+	}
+
+	user := interactionUser(e, ref)
+	db, err := mlService.HistoryDB(user)
+	if err != nil {
+		return replyNotice(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	reply, err := db.GetReply(ref.MessageID)
+	if err != nil {
+		return replyNotice(replyError(ErrReplyGone))
+	}
+
+	switch action {
+	case ReplyLike, ReplyDislike:
+		feedback := 1
+		if action == ReplyDislike {
+			feedback = -1
+		}
+		// Clicking the rating again takes it back
+		if reply.Feedback == feedback {
+			feedback = 0
+		}
+		if err := db.SetFeedback(ref.MessageID, feedback); err != nil {
+			return replyNotice(fmt.Sprintf("Cannot save your feedback: %v", err))
+		}
+		buttons := replyButtons(ref, feedback)
+		return &api.InteractionResponse{
+			Type: api.UpdateMessage,
+			Data: &api.InteractionResponseData{Components: &buttons},
+		}
+
+	case ReplyDelete:
+		go deleteReply(bot, e, db, ref, reply)
+		return &api.InteractionResponse{Type: api.DeferredMessageUpdate}
+
+	case ReplyRegenerate, ReplyContinue:
+		if !reply.Latest {
+			return replyNotice(replyError(ErrNotLatestReply))
+		}
+		if action == ReplyRegenerate {
+			go regenerateReply(bot, e, user, ref, reply)
+		} else {
+			go continueReply(bot, e, user, ref, reply)
+		}
+		// The buttons go away while the new text is written
+		return &api.InteractionResponse{
+			Type: api.UpdateMessage,
+			Data: &api.InteractionResponseData{Components: &discord.ContainerComponents{}},
+		}
+	}
+
+	return replyNotice("This button is no longer supported.")
+}
+
+// regenerateReply writes a new reply in place of the old one
+func regenerateReply(bot *state.State, e *discord.InteractionEvent, user ChatUser, ref ReplyRef, old StoredReply) {
+	renderer := newStreamRenderer(bot, e.ChannelID)
+	renderer.Reuse(replyMessageIDs(e, old))
+
+	var onDelta func(string)
+	if mlService.SupportsStreaming(user.ID) {
+		onDelta = renderer.Write
+	}
+	reply, err := mlService.Regenerate(user, ref.MessageID, onDelta)
+	if err != nil || reply.MessageID == 0 {
+		notice := reply.Text
+		if err != nil {
+			log.Printf("Error regenerating AI response: %v", err)
+			notice = replyError(err)
+		}
+		// The old reply stays in place unless the new one started to show
+		if renderer.Cancel() {
+			restoreReplyButtons(bot, e, ref, old.Feedback)
+			followUpNotice(bot, e, notice)
+			return
+		}
+		if err := renderer.Fail(notice, replyButtons(ref, old.Feedback)); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		return
+	}
+
+	if err := renderer.Finish(reply.Text, replyButtons(newReplyRef(user, reply.MessageID), 0)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+	saveReplyMessages(user, reply.MessageID, renderer.Messages())
+}
+
+// continueReply posts the continuation of a reply below it
+func continueReply(bot *state.State, e *discord.InteractionEvent, user ChatUser, ref ReplyRef, old StoredReply) {
+	renderer := newStreamRenderer(bot, e.ChannelID)
+	if err := renderer.Start(); err != nil {
+		log.Printf("Error sending placeholder message: %v", err)
+		restoreReplyButtons(bot, e, ref, old.Feedback)
+		return
+	}
+
+	var onDelta func(string)
+	if mlService.SupportsStreaming(user.ID) {
+		onDelta = renderer.Write
+	}
+	reply, err := mlService.Continue(user, ref.MessageID, onDelta)
+	if err != nil || reply.MessageID == 0 {
+		notice := reply.Text
+		if err != nil {
+			log.Printf("Error continuing AI response: %v", err)
+			notice = replyError(err)
+		}
+		if err := renderer.Fail(notice, nil); err != nil {
+			log.Printf("Error sending message: %v", err)
+		}
+		restoreReplyButtons(bot, e, ref, old.Feedback)
+		return
+	}
+
+	if err := renderer.Finish(reply.Text, replyButtons(ref, old.Feedback)); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+	messages := append(replyMessageIDs(e, old), renderer.Messages()...)
+	saveReplyMessages(user, ref.MessageID, messages)
+}
+
+// deleteReply removes a reply and the prompt it answered from the history,
+// and its messages from the channel
+func deleteReply(bot *state.State, e *discord.InteractionEvent, db *DBService, ref ReplyRef, reply StoredReply) {
+	if err := db.DeleteReply(ref.MessageID, true); err != nil {
+		log.Printf("Error deleting reply: %v", err)
+		followUpNotice(bot, e, fmt.Sprintf("Cannot delete the reply: %v", err))
+		return
+	}
+	for _, id := range replyMessageIDs(e, reply) {
+		if err := bot.DeleteMessage(e.ChannelID, id, "Reply deleted by its user"); err != nil {
+			log.Printf("Error deleting reply message: %v", err)
+		}
+	}
+}
+
+// replyMessageIDs returns the Discord messages showing a reply. Replies
+// saved before their messages were recorded only know the clicked one.
+func replyMessageIDs(e *discord.InteractionEvent, reply StoredReply) []discord.MessageID {
+	var messages []discord.MessageID
+	for _, id := range reply.DiscordIDs {
+		if snowflake, err := discord.ParseSnowflake(id); err == nil {
+			messages = append(messages, discord.MessageID(snowflake))
+		}
+	}
+	if len(messages) == 0 && e.Message != nil {
+		messages = append(messages, e.Message.ID)
+	}
+	return messages
+}
+
+// restoreReplyButtons puts the buttons back on the clicked message after
+// an action failed
+func restoreReplyButtons(bot *state.State, e *discord.InteractionEvent, ref ReplyRef, feedback int) {
+	if e.Message == nil {
+		return
+	}
+	buttons := replyButtons(ref, feedback)
+	if _, err := bot.EditMessageComplex(e.ChannelID, e.Message.ID, api.EditMessageData{Components: &buttons}); err != nil {
+		log.Printf("Error restoring reply buttons: %v", err)
+	}
+}
+
+// interactionUser describes who clicked a reply button for the ML service
+func interactionUser(e *discord.InteractionEvent, ref ReplyRef) ChatUser {
+	user := ChatUser{ID: ref.UserID, ChannelID: e.ChannelID.String(), ThreadID: ref.ThreadID}
+	if sender := e.Sender(); sender != nil {
+		user.Name = sender.Username
+	}
+	if e.GuildID.IsValid() {
+		user.GuildID = e.GuildID.String()
+	}
+	if e.Member != nil {
+		if e.Member.Nick != "" {
+			user.Name = e.Member.Nick
+		}
+		for _, roleID := range e.Member.RoleIDs {
+			user.RoleIDs = append(user.RoleIDs, roleID.String())
+		}
+	}
+	return user
+}
+
+// replyError explains why a reply button failed
+func replyError(err error) string {
+	switch {
+	case errors.Is(err, ErrReplyGone):
+		return "This reply is no longer in the history."
+	case errors.Is(err, ErrNotLatestReply):
+		return "Only the latest reply of a conversation can be regenerated or continued."
+	case errors.Is(err, ErrNoPrompt):
+		return "There is no message before this reply to answer again."
+	}
+	return UserFacingError(err)
+}
+
+// replyNotice answers a button click with a private message
+func replyNotice(content string) *api.InteractionResponse {
+	return &api.InteractionResponse{
+		Type: api.MessageInteractionWithSource,
+		Data: &api.InteractionResponseData{
+			Content: option.NewNullableString(content),
+			Flags:   discord.EphemeralMessage,
+		},
+	}
+}
+
+// followUpNotice sends a private message after a button click was answered
+func followUpNotice(bot *state.State, e *discord.InteractionEvent, content string) {
+	_, err := bot.FollowUpInteraction(e.AppID, e.Token, api.InteractionResponseData{
+		Content: option.NewNullableString(content),
+		Flags:   discord.EphemeralMessage,
+	})
+	if err != nil {
+		log.Printf("Error sending follow-up message: %v", err)
+	}
+}
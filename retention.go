@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultJanitorInterval is how often the janitor prunes every history
+	defaultJanitorInterval = 6 * time.Hour
+	// defaultVacuumInterval is how often the databases it pruned are vacuumed
+	defaultVacuumInterval = 7 * 24 * time.Hour
+)
+
+// RetentionPolicy limits how much history is kept: messages older than
+// MaxAgeDays are deleted, and so are those beyond the newest MaxMessages of
+// a database. Zero means no limit.
+type RetentionPolicy struct {
+	MaxAgeDays  int
+	MaxMessages int
+}
+
+// RetentionConfig is the server-wide policy and how often the janitor
+// enforces it
+type RetentionConfig struct {
+	Policy RetentionPolicy
+	// Interval is the time between two passes of the janitor
+	Interval time.Duration
+	// VacuumInterval is the time between two vacuums of a pruned database
+	VacuumInterval time.Duration
+}
+
+// retentionConfigFromEnv reads RETENTION_MAX_AGE_DAYS, RETENTION_MAX_MESSAGES,
+// RETENTION_INTERVAL and RETENTION_VACUUM_INTERVAL
+func retentionConfigFromEnv() (RetentionConfig, error) {
+	config := RetentionConfig{Interval: defaultJanitorInterval, VacuumInterval: defaultVacuumInterval}
+
+	for _, limit := range []struct {
+		name  string
+		value *int
+	}{
+		{"RETENTION_MAX_AGE_DAYS", &config.Policy.MaxAgeDays},
+		{"RETENTION_MAX_MESSAGES", &config.Policy.MaxMessages},
+	} {
+		value := strings.TrimSpace(os.Getenv(limit.name))
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("%s must be a whole number of 0 or more", limit.name)
+		}
+		*limit.value = n
+	}
+
+	for _, interval := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"RETENTION_INTERVAL", &config.Interval},
+		{"RETENTION_VACUUM_INTERVAL", &config.VacuumInterval},
+	} {
+		value := strings.TrimSpace(os.Getenv(interval.name))
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("%s must be a positive Go duration, e.g. 6h", interval.name)
+		}
+		*interval.value = d
+	}
+	return config, nil
+}
+
+// IsZero reports whether the policy keeps everything
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxAgeDays == 0 && p.MaxMessages == 0
+}
+
+// Stricter combines two policies, keeping the lower of each limit
+func (p RetentionPolicy) Stricter(other RetentionPolicy) RetentionPolicy {
+	return RetentionPolicy{
+		MaxAgeDays:  stricterLimit(p.MaxAgeDays, other.MaxAgeDays),
+		MaxMessages: stricterLimit(p.MaxMessages, other.MaxMessages),
+	}
+}
+
+// stricterLimit returns the lower of two limits, where 0 is no limit
+func stricterLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// String describes the policy for people
+func (p RetentionPolicy) String() string {
+	var limits []string
+	if p.MaxAgeDays > 0 {
+		limits = append(limits, "messages are deleted after "+pluralize(p.MaxAgeDays, "day"))
+	}
+	if p.MaxMessages > 0 {
+		limits = append(limits, "only the newest "+pluralize(p.MaxMessages, "message")+" are kept")
+	}
+	if len(limits) == 0 {
+		return "history is kept until deleted"
+	}
+	return strings.Join(limits, " and ")
+}
+
+// Retention returns the server-wide retention policy
+func (m *DatabaseManager) Retention() RetentionPolicy {
+	return m.retention
+}
+
+// UserRetention returns the policy applied to a user's history: the
+// server's, made stricter by the user's own limits
+func (m *DatabaseManager) UserRetention(db *DBService, userID string) (RetentionPolicy, error) {
+	own, err := db.GetRetention(userID)
+	if err != nil {
+		return m.retention, err
+	}
+	return m.retention.Stricter(own), nil
+}
+
+// StartJanitor enforces the retention policies in the background: every
+// interval it prunes each user and thread history, and it vacuums the pruned
+// databases every vacuum interval
+func (m *DatabaseManager) StartJanitor(config RetentionConfig) {
+	m.retention = config.Policy
+	go m.janitor(config)
+}
+
+func (m *DatabaseManager) janitor(config RetentionConfig) {
+	// Files of the databases pruned since the last vacuum
+	pruned := map[string]bool{}
+	lastVacuum := time.Now()
+
+	for {
+		m.pruneHistories(pruned)
+
+		if time.Since(lastVacuum) >= config.VacuumInterval {
+			m.vacuumHistories(pruned)
+			pruned = map[string]bool{}
+			lastVacuum = time.Now()
+		}
+		time.Sleep(config.Interval)
+	}
+}
+
+// pruneHistories applies the retention policies to every history once,
+// adding the databases it removed rows from to pruned
+func (m *DatabaseManager) pruneHistories(pruned map[string]bool) {
+	files, err := m.historyFiles()
+	if err != nil {
+		log.Printf("Retention: cannot list histories: %v", err)
+		return
+	}
+
+	var total Pruned
+	for _, file := range files {
+		removed, policy, err := m.pruneHistory(file)
+		if err != nil {
+			log.Printf("Retention: cannot prune %s: %v", file, err)
+			continue
+		}
+		if removed.Messages == 0 {
+			continue
+		}
+		log.Printf("Retention: removed %s and %s from %s (%s)", pluralize(removed.Messages, "message"),
+			pluralize(removed.Conversations, "conversation"), file, policy)
+		total.Messages += removed.Messages
+		total.Conversations += removed.Conversations
+		pruned[file] = true
+	}
+	if total.Messages > 0 {
+		log.Printf("Retention: removed %s and %s in all", pluralize(total.Messages, "message"),
+			pluralize(total.Conversations, "conversation"))
+	}
+}
+
+// pruneHistory applies the retention policy of one history. Threads are
+// shared, so only the server's policy applies to them and they aren't opened
+// when it keeps everything.
+func (m *DatabaseManager) pruneHistory(file string) (Pruned, RetentionPolicy, error) {
+	policy := m.retention
+	_, thread := historyKey(file)
+	if thread && policy.IsZero() {
+		return Pruned{}, policy, nil
+	}
+
+	db, release, err := m.openHistory(file)
+	if err != nil || db == nil {
+		return Pruned{}, policy, err
+	}
+	defer release()
+
+	if !thread {
+		id := strings.TrimSuffix(filepath.Base(file), ".db")
+		if policy, err = m.UserRetention(db, id); err != nil {
+			return Pruned{}, policy, err
+		}
+	}
+	if policy.IsZero() {
+		return Pruned{}, policy, nil
+	}
+	removed, err := db.ApplyRetention(policy)
+	return removed, policy, err
+}
+
+// vacuumHistories gives back the space freed in the pruned databases. Those
+// deleted since, e.g. with /deletedata, are skipped rather than opened again.
+func (m *DatabaseManager) vacuumHistories(pruned map[string]bool) {
+	for file := range pruned {
+		before := fileSize(file)
+		if before == 0 {
+			continue
+		}
+		db, release, err := m.openHistory(file)
+		if db == nil && err == nil {
+			continue
+		}
+		if err == nil {
+			err = db.Vacuum()
+			release()
+		}
+		if err != nil {
+			log.Printf("Retention: cannot vacuum %s: %v", file, err)
+			continue
+		}
+		log.Printf("Retention: vacuumed %s, freeing %s", file, formatBytes(max(before-fileSize(file), 0)))
+	}
+}
+
+// historyFiles lists the user and thread databases in the data directory.
+// User databases are named after the user's ID, which tells them apart from
+// the other databases kept there, such as quotas.
+func (m *DatabaseManager) historyFiles() ([]string, error) {
+	users, err := filepath.Glob(filepath.Join(m.dataDir, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range users {
+		if _, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".db"), 10, 64); err == nil {
+			files = append(files, file)
+		}
+	}
+	threads, err := filepath.Glob(filepath.Join(m.dataDir, "threads", "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, threads...), nil
+}
+
+// openHistory opens a database listed by historyFiles for the janitor. The
+// connection already in use is shared if there is one; otherwise the file is
+// opened outside the cache, so the janitor doesn't keep every history open.
+// release must be called once done with the database. It returns a nil
+// database when the file no longer exists, e.g. after /deletedata, rather
+// than creating it again.
+func (m *DatabaseManager) openHistory(file string) (*DBService, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, _ := historyKey(file)
+	if db, ok := m.dbs[key]; ok {
+		return db, func() {}, nil
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	// mode=rw fails instead of creating the file if it was deleted since
+	db, err := NewDB("file:" + file + "?mode=rw")
+	if err != nil {
+		if _, statErr := os.Stat(file); os.IsNotExist(statErr) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// historyKey returns the key a database listed by historyFiles is cached
+// under in the manager, and whether it holds a thread
+func historyKey(file string) (string, bool) {
+	id := strings.TrimSuffix(filepath.Base(file), ".db")
+	if filepath.Base(filepath.Dir(file)) == "threads" {
+		return "thread:" + id, true
+	}
+	return id, false
+}
+
+// fileSize returns the size of a file, or 0 when it cannot be read
+func fileSize(name string) int64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
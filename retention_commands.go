@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+)
+
+// retentionViewCommand shows the server's retention policy, the user's own
+// limits and what applies to their history
+func (h *aiCommandHandler) retentionViewCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	own, err := userDB.GetRetention(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get your retention limits: %v", err))
+	}
+	server := h.dbManager.Retention()
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "**Server:** %s.\n", server)
+	if own.IsZero() {
+		response.WriteString("**Yours:** none. Set stricter limits with `/retention set`.\n")
+	} else {
+		fmt.Fprintf(&response, "**Yours:** %s.\n", own)
+		fmt.Fprintf(&response, "**Applied to your history:** %s.\n", server.Stricter(own))
+	}
+	response.WriteString("Threads are shared, so only the server's policy applies to them.")
+
+	return h.chatResponse(response.String())
+}
+
+// retentionSetCommand sets the user's own retention limits, which can only
+// be stricter than the server's, and prunes their history right away
+func (h *aiCommandHandler) retentionSetCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	own, err := userDB.GetRetention(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get your retention limits: %v", err))
+	}
+
+	days, daysErr := data.Options.Find("days").IntValue()
+	messages, messagesErr := data.Options.Find("messages").IntValue()
+	if daysErr != nil && messagesErr != nil {
+		return h.errorResponse("Give `days`, `messages` or both.")
+	}
+	if daysErr == nil {
+		own.MaxAgeDays = int(days)
+	}
+	if messagesErr == nil {
+		own.MaxMessages = int(messages)
+	}
+
+	server := h.dbManager.Retention()
+	if server.MaxAgeDays > 0 && own.MaxAgeDays > server.MaxAgeDays {
+		return h.errorResponse(fmt.Sprintf("The server already deletes messages after %s; your limit can only be stricter.",
+			pluralize(server.MaxAgeDays, "day")))
+	}
+	if server.MaxMessages > 0 && own.MaxMessages > server.MaxMessages {
+		return h.errorResponse(fmt.Sprintf("The server already keeps only the newest %s; your limit can only be stricter.",
+			pluralize(server.MaxMessages, "message")))
+	}
+
+	if err := userDB.SetRetention(userID, own); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot save your retention limits: %v", err))
+	}
+	policy := server.Stricter(own)
+	removed, err := userDB.ApplyRetention(policy)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Saved your limits, but cannot apply them yet: %v", err))
+	}
+
+	response := fmt.Sprintf("Saved. In your history, %s.", policy)
+	if removed.Messages > 0 {
+		response += fmt.Sprintf(" Removed %s and %s now.", pluralize(removed.Messages, "message"),
+			pluralize(removed.Conversations, "conversation"))
+	}
+	return h.chatResponse(response)
+}
+
+// retentionResetCommand removes the user's own retention limits
+func (h *aiCommandHandler) retentionResetCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID().String()
+	userDB, err := h.dbManager.GetUserDB(userID)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	if err := userDB.SetRetention(userID, RetentionPolicy{}); err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot reset your retention limits: %v", err))
+	}
+	return h.chatResponse(fmt.Sprintf("Removed your own limits. In your history, %s.", h.dbManager.Retention()))
+}
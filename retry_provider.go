@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRetryMaxAttempts = 3
+
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+	// retryMaxWait is the longest Retry-After we sit through; longer waits are
+	// reported to the user instead
+	retryMaxWait = 60 * time.Second
+)
+
+// RetryPolicy controls how a RetryProvider retries failed calls
+type RetryPolicy struct {
+	// MaxAttempts counts the first call; 1 disables retries
+	MaxAttempts int
+	// RetryOn lists the error kinds worth retrying
+	RetryOn []error
+}
+
+// DefaultRetryPolicy retries transient failures up to three times
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DefaultRetryMaxAttempts,
+		RetryOn:     []error{ErrRateLimited, ErrUnavailable, ErrTimeout},
+	}
+}
+
+// retryPolicyFromEnv reads <PREFIX>_MAX_ATTEMPTS and <PREFIX>_RETRY_ON,
+// falling back to RETRY_MAX_ATTEMPTS, RETRY_ON and then the defaults
+func retryPolicyFromEnv(prefix string) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+
+	if value := envOr(prefix+"_MAX_ATTEMPTS", "RETRY_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("invalid max attempts %q", value)
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	if value := envOr(prefix+"_RETRY_ON", "RETRY_ON"); value != "" {
+		kinds, err := parseErrorKinds(value)
+		if err != nil {
+			return policy, err
+		}
+		policy.RetryOn = kinds
+	}
+
+	return policy, nil
+}
+
+// envOr returns the first of the given environment variables that is set
+func envOr(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// RetryProvider wraps an AIProvider and retries failed calls with exponential
+// backoff and jitter, waiting as long as the provider asks when it says so
+type RetryProvider struct {
+	AIProvider
+	policy RetryPolicy
+}
+
+// retryStreamingProvider is a RetryProvider for providers that can stream
+type retryStreamingProvider struct {
+	*RetryProvider
+	streamer StreamingProvider
+}
+
+// NewRetryProvider wraps provider with the retry policy. The result
+// implements StreamingProvider only if provider does.
+func NewRetryProvider(provider AIProvider, policy RetryPolicy) AIProvider {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	retry := &RetryProvider{AIProvider: provider, policy: policy}
+	if streamer, ok := provider.(StreamingProvider); ok {
+		return &retryStreamingProvider{RetryProvider: retry, streamer: streamer}
+	}
+	return retry
+}
+
+func (r *RetryProvider) GetResponse(ctx context.Context, req ChatRequest) (ChatResponse, error) {
+	var response ChatResponse
+	err := r.do(ctx, func() (bool, error) {
+		var err error
+		response, err = r.AIProvider.GetResponse(ctx, req)
+		return true, err
+	})
+	return response, err
+}
+
+// ListModels retries model discovery; providers without it report their static list
+func (r *RetryProvider) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	lister, ok := r.AIProvider.(ModelLister)
+	if !ok {
+		return staticModels(r.AIProvider), nil
+	}
+
+	var models []ModelInfo
+	err := r.do(ctx, func() (bool, error) {
+		var err error
+		models, err = lister.ListModels(ctx)
+		return true, err
+	})
+	return models, err
+}
+
+// SupportsTools reports whether the wrapped provider can call tools
+func (r *RetryProvider) SupportsTools() bool {
+	tools, ok := r.AIProvider.(ToolProvider)
+	return ok && tools.SupportsTools()
+}
+
+// SupportsVision reports whether the wrapped provider accepts images for a model
+func (r *RetryProvider) SupportsVision(model string) bool {
+	vision, ok := r.AIProvider.(VisionProvider)
+	return ok && vision.SupportsVision(model)
+}
+
+// StreamResponse retries a stream only while nothing has been shown to the
+// user yet; once a fragment was delivered a retry would repeat it
+func (r *retryStreamingProvider) StreamResponse(ctx context.Context, req ChatRequest, onDelta func(string)) (ChatResponse, error) {
+	var response ChatResponse
+	err := r.do(ctx, func() (bool, error) {
+		started := false
+		var err error
+		response, err = r.streamer.StreamResponse(ctx, req, func(delta string) {
+			started = true
+			onDelta(delta)
+		})
+		return !started, err
+	})
+	return response, err
+}
+
+// do runs call until it succeeds, fails with an error the policy doesn't
+// retry, the attempts run out or ctx is cancelled. call reports whether it is
+// safe to run again.
+func (r *RetryProvider) do(ctx context.Context, call func() (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		retryable, err := call()
+		if err == nil || !retryable || attempt >= r.policy.MaxAttempts || !isErrorKind(err, r.policy.RetryOn) {
+			return err
+		}
+
+		delay := backoff(attempt)
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) && providerErr.RetryAfter > 0 {
+			if providerErr.RetryAfter > retryMaxWait {
+				return err
+			}
+			delay = providerErr.RetryAfter
+		}
+
+		log.Printf("%s call failed (attempt %d/%d), retrying in %v: %v", r.GetName(), attempt, r.policy.MaxAttempts, delay.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the given retry: exponential growth from
+// retryBaseDelay, capped at retryMaxDelay, with the upper half jittered
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
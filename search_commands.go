@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	// maxSearchResults bounds the results listed by /search
+	maxSearchResults = 10
+	// maxSearchQuote bounds each message of an exchange shown from the results
+	maxSearchQuote = 800
+	// maxSearchContext bounds each message of an exchange added to a conversation
+	maxSearchContext = 4000
+)
+
+// Actions of the menus under search results
+const (
+	SearchJump = "jump"
+	SearchUse  = "use"
+)
+
+// searchMenuPrefix starts the custom ID of the search menus, e.g. "search:jump"
+const searchMenuPrefix = "search"
+
+// searchCommand lists the messages of the user's history matching a query
+func (h *aiCommandHandler) searchCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	text := strings.TrimSpace(data.Options.Find("query").String())
+	query := searchQuery(text)
+	if query == "" {
+		return h.errorResponse("Enter the words to search for.")
+	}
+
+	db, err := h.dbManager.GetUserDB(data.Event.SenderID().String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	results, err := db.SearchMessages(query, maxSearchResults)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot search: %v", err))
+	}
+	if len(results) == 0 {
+		return h.chatResponse(fmt.Sprintf("Nothing in your conversations matches “%s”.", text))
+	}
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "**Results for “%s”:**\n", text)
+	footer := "\nPick a result below to jump to it, or to add it to the conversation in this channel."
+	for i, result := range results {
+		entry := fmt.Sprintf("**%d.** %s `#%d` · %s · <t:%d:d>\n> %s\n", i+1,
+			formatConversationTitle(Conversation{Title: result.Title}), result.ConversationID,
+			searchSpeaker(result.Role, result.UserName), result.Time.Unix(), strings.Join(strings.Fields(result.Snippet), " "))
+		if response.Len()+len(entry)+len(footer) > MaxMessageLength {
+			results = results[:i]
+			break
+		}
+		response.WriteString(entry)
+	}
+	response.WriteString(footer)
+
+	menus := searchMenus(results)
+	return &api.InteractionResponseData{
+		Content:    option.NewNullableString(response.String()),
+		Flags:      discord.EphemeralMessage,
+		Components: &menus,
+	}
+}
+
+// searchQuery turns the words typed into an FTS5 query for messages holding
+// all of them. Each word is quoted so that punctuation isn't read as query
+// syntax.
+func searchQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchSpeaker names who wrote a found message, from the user's side
+func searchSpeaker(role, userName string) string {
+	if role == RoleUser {
+		return "You"
+	}
+	if userName == "" {
+		return "Kurosawa"
+	}
+	return userName
+}
+
+// searchMenus are the menus under search results: one to jump to a result,
+// one to add it to the conversation active in the channel
+func searchMenus(results []SearchResult) discord.ContainerComponents {
+	if len(results) == 0 {
+		return nil
+	}
+
+	options := make([]discord.SelectOption, len(results))
+	for i, result := range results {
+		title := result.Title
+		if title == "" {
+			title = "Untitled conversation"
+		}
+		snippet := strings.Join(strings.Fields(strings.ReplaceAll(result.Snippet, "**", "")), " ")
+		options[i] = discord.SelectOption{
+			Label:       truncate(fmt.Sprintf("%d. %s", i+1, title), 97),
+			Value:       strconv.FormatInt(result.MessageID, 10),
+			Description: truncate(fmt.Sprintf("%s · %s", searchSpeaker(result.Role, result.UserName), snippet), 97),
+		}
+	}
+
+	return discord.ContainerComponents{
+		&discord.ActionRowComponent{
+			&discord.StringSelectComponent{
+				CustomID:    discord.ComponentID(searchMenuPrefix + ":" + SearchJump),
+				Placeholder: "Jump to a result…",
+				Options:     options,
+			},
+		},
+		&discord.ActionRowComponent{
+			&discord.StringSelectComponent{
+				CustomID:    discord.ComponentID(searchMenuPrefix + ":" + SearchUse),
+				Placeholder: "Add a result to this channel's conversation…",
+				Options:     options,
+			},
+		},
+	}
+}
+
+// parseSearchMenu decodes the custom ID of a search menu
+func parseSearchMenu(customID discord.ComponentID) (string, bool) {
+	prefix, action, ok := strings.Cut(string(customID), ":")
+	return action, ok && prefix == searchMenuPrefix
+}
+
+// handleSearchMenu handles a result picked in the search menus. The results
+// are private, so whoever picks one is the user who searched.
+func handleSearchMenu(e *discord.InteractionEvent, action string, values []string) *api.InteractionResponse {
+	if len(values) != 1 {
+		return nil
+	}
+	messageID, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	db, err := dbManager.GetUserDB(e.SenderID().String())
+	if err != nil {
+		return replyNotice(fmt.Sprintf("Cannot access database: %v", err))
+	}
+	conversation, err := db.MessageConversation(messageID)
+	if err == sql.ErrNoRows {
+		return replyNotice("This message is no longer in your history.")
+	}
+	if err != nil {
+		return replyNotice(fmt.Sprintf("Cannot get conversation: %v", err))
+	}
+	messages, err := db.GetMessages(conversation.ID)
+	if err != nil {
+		return replyNotice(fmt.Sprintf("Cannot get messages: %v", err))
+	}
+	found, prompt, reply := searchExchange(messages, messageID)
+
+	switch action {
+	case SearchJump:
+		return replyNotice(truncate(searchJump(db, e, conversation, found, prompt, reply), MaxMessageLength))
+	case SearchUse:
+		return replyNotice(searchUse(e, conversation, found, prompt, reply))
+	}
+	return nil
+}
+
+// searchJump shows a found exchange and continues its conversation in the
+// channel
+func searchJump(db *DBService, e *discord.InteractionEvent, conversation Conversation, found, prompt, reply Message) string {
+	var response strings.Builder
+	fmt.Fprintf(&response, "%s `#%d`, <t:%d:f>:\n", formatConversationTitle(conversation), conversation.ID, searchTime(found).Unix())
+	for _, msg := range []Message{prompt, reply} {
+		if msg.ID == 0 {
+			continue
+		}
+		text := fmt.Sprintf("**%s:** %s", searchSpeaker(msg.Role, msg.UserName), truncate(strings.TrimSpace(msg.Content), maxSearchQuote))
+		response.WriteString("> " + strings.ReplaceAll(text, "\n", "\n> ") + "\n")
+	}
+
+	// Threads keep a history of their own, which the user's conversations
+	// can't be continued in
+	if ch, err := botState.Channel(e.ChannelID); err == nil && isThread(ch) {
+		fmt.Fprintf(&response, "Continue this conversation outside the thread with `/chat switch id:%d`.", conversation.ID)
+		return response.String()
+	}
+	if err := db.SetActiveConversation(e.ChannelID.String(), conversation.ID); err != nil {
+		fmt.Fprintf(&response, "Cannot switch to this conversation: %v", err)
+		return response.String()
+	}
+	response.WriteString("Switched this channel to this conversation; your next message continues it.")
+	return response.String()
+}
+
+// searchUse adds a found exchange to the conversation active in the channel
+// as a user turn, which the next message is sent along with
+func searchUse(e *discord.InteractionEvent, conversation Conversation, found, prompt, reply Message) string {
+	historyDB, err := channelHistory(dbManager, e.ChannelID, e.SenderID())
+	if err != nil {
+		return fmt.Sprintf("Cannot access database: %v", err)
+	}
+	active, err := historyDB.ActiveConversation(e.ChannelID.String())
+	if err != nil {
+		return fmt.Sprintf("Cannot get conversation: %v", err)
+	}
+
+	title := conversation.Title
+	if title == "" {
+		title = "Untitled conversation"
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, "For context, from an earlier conversation, “%s”, on %s:", title, searchTime(found).Format("2006-01-02"))
+	if prompt.ID != 0 {
+		fmt.Fprintf(&text, "\n\nUser: %s", truncate(strings.TrimSpace(prompt.Content), maxSearchContext))
+	}
+	if reply.ID != 0 {
+		fmt.Fprintf(&text, "\n\nAssistant: %s", truncate(strings.TrimSpace(reply.Content), maxSearchContext))
+	}
+
+	user := interactionUser(e, ReplyRef{UserID: e.SenderID().String()})
+	if err := historyDB.AddUserMessage(active.ID, user.ID, user.Name, text.String(), nil, ""); err != nil {
+		return fmt.Sprintf("Cannot add the exchange: %v", err)
+	}
+	return fmt.Sprintf("Added the exchange from %s to %s. Your next message is sent along with it.",
+		formatConversationTitle(conversation), formatConversationTitle(active))
+}
+
+// searchExchange returns a found message with the exchange it belongs to:
+// the user turn and the reply that answered it. Either is left empty when
+// missing.
+func searchExchange(messages []Message, messageID int64) (found, prompt, reply Message) {
+	i := slices.IndexFunc(messages, func(msg Message) bool { return msg.ID == messageID })
+	if i < 0 {
+		return
+	}
+	found = messages[i]
+
+	if found.Role == RoleUser {
+		prompt = found
+		for _, msg := range messages[i+1:] {
+			if msg.Role == RoleUser {
+				break
+			}
+			if msg.Role == RoleAssistant && len(msg.ToolCalls) == 0 {
+				reply = msg
+				break
+			}
+		}
+		return
+	}
+
+	reply = found
+	for j := i - 1; j >= 0; j-- {
+		if messages[j].Role == RoleUser {
+			prompt = messages[j]
+			break
+		}
+	}
+	return
+}
+
+// searchTime returns when a found message was written
+func searchTime(msg Message) time.Time {
+	t, _ := time.Parse(time.RFC3339, msg.Time)
+	return t
+}
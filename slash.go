@@ -4,8 +4,35 @@ import (
 	"github.com/diamondburned/arikawa/v3/api"
 	"github.com/diamondburned/arikawa/v3/discord"
 	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
 )
 
+// quotaSetOptions builds the options of a /quota subcommand that sets a limit
+func quotaSetOptions(target discord.CommandOptionValue) []discord.CommandOptionValue {
+	limitChoices := make([]discord.StringChoice, len(quotaLimits))
+	for i, limit := range quotaLimits {
+		limitChoices[i] = discord.StringChoice{Name: limit.Name, Value: limit.Name}
+	}
+
+	var options []discord.CommandOptionValue
+	if target != nil {
+		options = append(options, target)
+	}
+	return append(options,
+		&discord.StringOption{
+			OptionName:  "limit",
+			Description: "Which allowance to set",
+			Required:    true,
+			Choices:     limitChoices,
+		},
+		&discord.NumberOption{
+			OptionName:  "value",
+			Description: "Messages, tokens or US dollars; -1 for unlimited, leave empty to remove the rule",
+			Required:    false,
+		},
+	)
+}
+
 func RegisterSlashCommands(bot *state.State, guildID discord.GuildID) error {
 	app, err := bot.CurrentApplication()
 	if err != nil {
@@ -29,6 +56,56 @@ func RegisterSlashCommands(bot *state.State, guildID discord.GuildID) error {
 			Name:        "ai",
 			Description: "Start a private conversation with the AI",
 		},
+		{
+			Name:        "thread",
+			Description: "Start a thread for a new topic, shared with everyone who joins it",
+			Options: []discord.CommandOption{
+				&discord.StringOption{
+					OptionName:  "topic",
+					Description: "Name of the thread",
+					Required:    false,
+					MaxLength:   option.NewInt(maxThreadName),
+				},
+			},
+		},
+		{
+			Name:        "export",
+			Description: "Download your conversations with the AI",
+			Options: []discord.CommandOption{
+				&discord.StringOption{
+					OptionName:  "format",
+					Description: "File format (default Markdown)",
+					Required:    false,
+					Choices: []discord.StringChoice{
+						{Name: "Markdown transcript", Value: ExportMarkdown},
+						{Name: "JSON", Value: ExportJSON},
+						{Name: "HTML page", Value: ExportHTML},
+					},
+				},
+				&discord.IntegerOption{
+					OptionName:  "id",
+					Description: "Only export this conversation (number from /chat list)",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "import",
+			Description: "Add conversations from a /export JSON file or a ChatGPT export",
+			Options: []discord.CommandOption{
+				&discord.AttachmentOption{
+					OptionName:  "file",
+					Description: "JSON from /export, or ChatGPT's conversations.json (or its zip)",
+					Required:    true,
+				},
+				&discord.StringOption{
+					OptionName:  "title",
+					Description: "Import everything as one conversation with this title",
+					Required:    false,
+					MaxLength:   option.NewInt(maxConversationTitle),
+				},
+			},
+		},
 		{
 			Name:        "deletedata",
 			Description: "Delete all your data from the bot's database",
@@ -37,13 +114,161 @@ func RegisterSlashCommands(bot *state.State, guildID discord.GuildID) error {
 			Name:        "clearhistory",
 			Description: "Clear your conversation history with the AI",
 		},
+		{
+			Name:        "chat",
+			Description: "Keep several conversations with the AI",
+			Options: []discord.CommandOption{
+				&discord.SubcommandOption{
+					OptionName:  "new",
+					Description: "Start a new conversation in this channel",
+					Options: []discord.CommandOptionValue{
+						&discord.StringOption{
+							OptionName:  "title",
+							Description: "Title (by default one is written after the first reply)",
+							Required:    false,
+							MaxLength:   option.NewInt(maxConversationTitle),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "list",
+					Description: "List your conversations",
+				},
+				&discord.SubcommandOption{
+					OptionName:  "switch",
+					Description: "Continue another conversation in this channel",
+					Options: []discord.CommandOptionValue{
+						&discord.IntegerOption{
+							OptionName:  "id",
+							Description: "Conversation number from /chat list",
+							Required:    true,
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "delete",
+					Description: "Delete a conversation and its messages",
+					Options: []discord.CommandOptionValue{
+						&discord.IntegerOption{
+							OptionName:  "id",
+							Description: "Conversation number from /chat list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:        "branches",
+			Description: "List the branches started by editing your messages, or continue one",
+			Options: []discord.CommandOption{
+				&discord.IntegerOption{
+					OptionName:  "id",
+					Description: "Branch number to continue in this channel",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "search",
+			Description: "Search your conversations",
+			Options: []discord.CommandOption{
+				&discord.StringOption{
+					OptionName:  "query",
+					Description: "Words to look for",
+					Required:    true,
+				},
+			},
+		},
+		{
+			Name:        "persona",
+			Description: "Talk to the AI through your own system prompts",
+			Options: []discord.CommandOption{
+				&discord.SubcommandOption{
+					OptionName:  "create",
+					Description: "Write the system prompt of a new persona",
+					Options: []discord.CommandOptionValue{
+						&discord.StringOption{
+							OptionName:  "name",
+							Description: "Name of the new persona",
+							Required:    true,
+							MaxLength:   option.NewInt(maxPersonaName),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "edit",
+					Description: "Change the system prompt of a persona",
+					Options: []discord.CommandOptionValue{
+						&discord.StringOption{
+							OptionName:  "name",
+							Description: "Persona from /persona list",
+							Required:    true,
+							MaxLength:   option.NewInt(maxPersonaName),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "list",
+					Description: "List your personas",
+				},
+				&discord.SubcommandOption{
+					OptionName:  "use",
+					Description: "Have the AI answer you as one of your personas",
+					Options: []discord.CommandOptionValue{
+						&discord.StringOption{
+							OptionName:  "name",
+							Description: "Persona from /persona list",
+							Required:    true,
+							MaxLength:   option.NewInt(maxPersonaName),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "reset",
+					Description: "Go back to the default Kurosawa prompt",
+				},
+			},
+		},
+		{
+			Name:        "retention",
+			Description: "See how long your history is kept, or keep it for less",
+			Options: []discord.CommandOption{
+				&discord.SubcommandOption{
+					OptionName:  "view",
+					Description: "Show the server's retention policy and your own limits",
+				},
+				&discord.SubcommandOption{
+					OptionName:  "set",
+					Description: "Set your own limits, stricter than the server's (0 for none)",
+					Options: []discord.CommandOptionValue{
+						&discord.IntegerOption{
+							OptionName:  "days",
+							Description: "Delete your messages after this many days",
+							Required:    false,
+							Min:         option.NewInt(0),
+						},
+						&discord.IntegerOption{
+							OptionName:  "messages",
+							Description: "Keep only this many of your newest messages",
+							Required:    false,
+							Min:         option.NewInt(0),
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "reset",
+					Description: "Remove your own limits, keeping only the server's",
+				},
+			},
+		},
 		{
 			Name:        "provider",
 			Description: "Select or view your AI provider",
 			Options: []discord.CommandOption{
 				&discord.StringOption{
 					OptionName:  "name",
-					Description: "Provider name (gemini, openai, mistral, openrouter)",
+					Description: "Provider name (run /provider without a name to list them)",
 					Required:    false,
 				},
 			},
@@ -57,6 +282,152 @@ func RegisterSlashCommands(bot *state.State, guildID discord.GuildID) error {
 					Description: "Model name",
 					Required:    false,
 				},
+				&discord.StringOption{
+					OptionName:  "search",
+					Description: "Only list models whose name contains this text",
+					Required:    false,
+				},
+				&discord.BooleanOption{
+					OptionName:  "refresh",
+					Description: "Reload the model list from the provider",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "failover",
+			Description: "View or set the providers to fall back on when yours fails",
+			Options: []discord.CommandOption{
+				&discord.StringOption{
+					OptionName:  "chain",
+					Description: "Comma-separated provider or provider:model list, e.g. mistral,gemini",
+					Required:    false,
+				},
+				&discord.BooleanOption{
+					OptionName:  "reset",
+					Description: "Use the server's default chain again",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "aiparams",
+			Description: "View or set your generation parameters",
+			Options: []discord.CommandOption{
+				&discord.NumberOption{
+					OptionName:  "temperature",
+					Description: "Randomness, 0 to 2 (Anthropic caps it at 1)",
+					Required:    false,
+					Min:         option.NewFloat(0),
+					Max:         option.NewFloat(2),
+				},
+				&discord.NumberOption{
+					OptionName:  "top_p",
+					Description: "Nucleus sampling, 0 to 1",
+					Required:    false,
+					Min:         option.NewFloat(0),
+					Max:         option.NewFloat(1),
+				},
+				&discord.IntegerOption{
+					OptionName:  "max_tokens",
+					Description: "Maximum length of a response in tokens",
+					Required:    false,
+					Min:         option.NewInt(1),
+				},
+				&discord.IntegerOption{
+					OptionName:  "seed",
+					Description: "Seed for more reproducible responses",
+					Required:    false,
+				},
+				&discord.StringOption{
+					OptionName:  "stop",
+					Description: "Stop sequences separated by | (use \\n for a newline)",
+					Required:    false,
+				},
+				&discord.StringOption{
+					OptionName:  "reasoning_effort",
+					Description: "How much reasoning models think before answering",
+					Required:    false,
+					Choices: []discord.StringChoice{
+						{Name: "minimal", Value: ReasoningMinimal},
+						{Name: "low", Value: ReasoningLow},
+						{Name: "medium", Value: ReasoningMedium},
+						{Name: "high", Value: ReasoningHigh},
+					},
+				},
+				&discord.StringOption{
+					OptionName:  "clear",
+					Description: "Go back to the provider default for a parameter",
+					Required:    false,
+					Choices: []discord.StringChoice{
+						{Name: "all", Value: "all"},
+						{Name: "temperature", Value: "temperature"},
+						{Name: "top_p", Value: "top_p"},
+						{Name: "max_tokens", Value: "max_tokens"},
+						{Name: "seed", Value: "seed"},
+						{Name: "stop", Value: "stop"},
+						{Name: "reasoning_effort", Value: "reasoning_effort"},
+					},
+				},
+			},
+		},
+		{
+			Name:        "usage",
+			Description: "View your AI token usage and cost",
+			Options: []discord.CommandOption{
+				&discord.IntegerOption{
+					OptionName:  "days",
+					Description: "How many days to include (default 30)",
+					Required:    false,
+					Min:         option.NewInt(1),
+					Max:         option.NewInt(365),
+				},
+			},
+		},
+		{
+			Name:                     "quota",
+			Description:              "Inspect and adjust AI allowances (admins only)",
+			DefaultMemberPermissions: discord.NewPermissions(discord.PermissionManageGuild),
+			Options: []discord.CommandOption{
+				&discord.SubcommandOption{
+					OptionName:  "view",
+					Description: "Show the quota rules, or a user's allowances and usage",
+					Options: []discord.CommandOptionValue{
+						&discord.UserOption{
+							OptionName:  "user",
+							Description: "User to inspect",
+							Required:    false,
+						},
+					},
+				},
+				&discord.SubcommandOption{
+					OptionName:  "user",
+					Description: "Set a limit for one user",
+					Options: quotaSetOptions(&discord.UserOption{
+						OptionName:  "user",
+						Description: "User the limit applies to",
+						Required:    true,
+					}),
+				},
+				&discord.SubcommandOption{
+					OptionName:  "role",
+					Description: "Set a limit for members of a role (the most generous role wins)",
+					Options: quotaSetOptions(&discord.RoleOption{
+						OptionName:  "role",
+						Description: "Role the limit applies to",
+						Required:    true,
+					}),
+				},
+				&discord.SubcommandOption{
+					OptionName:  "default",
+					Description: "Set a limit for everyone without a user or role rule",
+					Options:     quotaSetOptions(nil),
+				},
+				&discord.SubcommandOption{
+					OptionName:  "guild",
+					Description: "Set a limit on the combined usage of the whole server",
+					Options:     quotaSetOptions(nil),
+				},
 			},
 		},
 		{
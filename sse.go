@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// chatCompletionChunk is a single event of an OpenAI-style streamed chat completion
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string                   `json:"content"`
+			ToolCalls []ChatCompletionToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage is sent with the last chunk
+	Usage *ChatCompletionUsage `json:"usage,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// readSSE reads a server-sent events stream and calls onData with the payload
+// of every "data:" line until the stream ends or onData returns false
+func readSSE(body io.Reader, onData func(data string) (bool, error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Blank lines separate events; lines starting with ':' are keep-alive comments
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+
+		more, err := onData(strings.TrimSpace(data))
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// readChatCompletionStream reads an OpenAI-compatible chat completion stream,
+// calling onDelta for each content fragment, and returns the full text, the
+// tool calls and the usage reported at the end
+func readChatCompletionStream(body io.Reader, onDelta func(string)) (ChatResponse, error) {
+	var response strings.Builder
+	var usage Usage
+	// Tool calls arrive in pieces keyed by index: the ID and name first, then
+	// fragments of the arguments
+	var calls []ChatCompletionToolCall
+
+	err := readSSE(body, func(data string) (bool, error) {
+		if data == "[DONE]" {
+			return false, nil
+		}
+
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return false, fmt.Errorf("invalid stream chunk: %w", err)
+		}
+		if chunk.Error != nil {
+			kind := ErrUnavailable
+			if isContextTooLong(chunk.Error.Message) {
+				kind = ErrContextTooLong
+			}
+			return false, &ProviderError{Kind: kind, Message: chunk.Error.Message}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.toUsage()
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason == "content_filter" {
+				return false, &ProviderError{Kind: ErrContentBlocked, Message: "response stopped by the content filter"}
+			}
+			for _, delta := range choice.Delta.ToolCalls {
+				for len(calls) <= delta.Index {
+					calls = append(calls, ChatCompletionToolCall{})
+				}
+				call := &calls[delta.Index]
+				if delta.ID != "" {
+					call.ID = delta.ID
+				}
+				if delta.Function.Name != "" {
+					call.Function.Name = delta.Function.Name
+				}
+				call.Function.Arguments += delta.Function.Arguments
+			}
+			if choice.Delta.Content == "" {
+				continue
+			}
+			response.WriteString(choice.Delta.Content)
+			onDelta(choice.Delta.Content)
+		}
+		return true, nil
+	})
+
+	result := ChatResponse{Content: response.String(), Usage: usage}
+	if len(calls) > 0 {
+		result.ToolCalls = toToolCalls(calls)
+	}
+	return result, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	// StreamEditInterval is the minimum delay between edits of a streamed reply,
+	// which keeps us well inside Discord's message edit rate limits
+	StreamEditInterval = 1500 * time.Millisecond
+
+	streamPlaceholder = "*Thinking...*"
+)
+
+// streamRenderer shows a streamed AI response in Discord. It posts a
+// placeholder message and edits it as text arrives, moving into new
+// messages whenever the text crosses MaxMessageLength.
+type streamRenderer struct {
+	bot       *state.State
+	channelID discord.ChannelID
+
+	mu    sync.Mutex
+	text  strings.Builder
+	dirty bool
+
+	// messages and shown are only touched by the edit loop and by Finish
+	messages []discord.MessageID
+	shown    []string
+	// reused marks messages of an earlier reply that may still carry its
+	// buttons; they are cleared on the first edit
+	reused []bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newStreamRenderer(bot *state.State, channelID discord.ChannelID) *streamRenderer {
+	return &streamRenderer{
+		bot:       bot,
+		channelID: channelID,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start posts the placeholder message and begins the edit loop
+func (r *streamRenderer) Start() error {
+	msg, err := r.bot.SendMessage(r.channelID, streamPlaceholder)
+	if err != nil {
+		return err
+	}
+	r.messages = append(r.messages, msg.ID)
+	r.shown = append(r.shown, streamPlaceholder)
+	r.reused = append(r.reused, false)
+
+	r.wg.Add(1)
+	go r.loop()
+	return nil
+}
+
+// Reuse takes over the messages of an earlier reply, which the new text is
+// written into, and begins the edit loop. The messages keep their text until
+// the new text arrives, and lose their buttons once it does; Finish puts
+// them back on the last message.
+func (r *streamRenderer) Reuse(messages []discord.MessageID) {
+	r.messages = slices.Clone(messages)
+	r.shown = make([]string, len(messages))
+	r.reused = make([]bool, len(messages))
+	for i := range r.reused {
+		r.reused[i] = true
+	}
+
+	r.wg.Add(1)
+	go r.loop()
+}
+
+// Messages returns the messages showing the reply
+func (r *streamRenderer) Messages() []discord.MessageID {
+	return r.messages
+}
+
+// Write appends a streamed text fragment. It is safe for concurrent use.
+func (r *streamRenderer) Write(delta string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.text.WriteString(delta)
+	r.dirty = true
+}
+
+// Finish stops the edit loop and renders the final response. buttons, if
+// any, are attached to its last message.
+func (r *streamRenderer) Finish(response string, buttons discord.ContainerComponents) error {
+	close(r.done)
+	r.wg.Wait()
+	if err := r.render(response); err != nil {
+		return err
+	}
+	if len(buttons) == 0 || len(r.messages) == 0 {
+		return nil
+	}
+	_, err := r.bot.EditMessageComplex(r.channelID, r.messages[len(r.messages)-1], api.EditMessageData{Components: &buttons})
+	return err
+}
+
+// Fail stops the edit loop and appends notice to whatever was streamed so far
+func (r *streamRenderer) Fail(notice string, buttons discord.ContainerComponents) error {
+	r.mu.Lock()
+	partial := strings.TrimSpace(r.text.String())
+	r.mu.Unlock()
+
+	if partial != "" {
+		notice = partial + "\n\n" + notice
+	}
+	return r.Finish(notice, buttons)
+}
+
+// Cancel stops the edit loop and leaves the messages as they are. It only
+// works before any text was streamed, and reports whether it did; once text
+// may be showing, the caller has to Finish or Fail instead.
+func (r *streamRenderer) Cancel() bool {
+	r.mu.Lock()
+	streamed := r.text.Len() > 0
+	r.mu.Unlock()
+	if streamed {
+		return false
+	}
+
+	close(r.done)
+	r.wg.Wait()
+	return true
+}
+
+// loop renders the accumulated text at most once per StreamEditInterval
+func (r *streamRenderer) loop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(StreamEditInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if !r.dirty {
+				r.mu.Unlock()
+				continue
+			}
+			text := r.text.String()
+			r.dirty = false
+			r.mu.Unlock()
+
+			if err := r.render(text); err != nil {
+				log.Printf("Error updating streamed message: %v", err)
+			}
+		}
+	}
+}
+
+// render brings the posted messages in line with text: changed parts are
+// edited, new parts are sent, and leftover messages are deleted
+func (r *streamRenderer) render(text string) error {
+	parts := splitMessage(strings.TrimSpace(text), MaxMessageLength)
+	if len(parts) == 1 && parts[0] == "" {
+		return nil
+	}
+
+	for i, part := range parts {
+		if i < len(r.messages) {
+			if r.shown[i] == part {
+				continue
+			}
+			if err := r.edit(i, part); err != nil {
+				return err
+			}
+			r.shown[i] = part
+			continue
+		}
+
+		msg, err := r.bot.SendMessage(r.channelID, part)
+		if err != nil {
+			return err
+		}
+		r.messages = append(r.messages, msg.ID)
+		r.shown = append(r.shown, part)
+		r.reused = append(r.reused, false)
+	}
+
+	for len(r.messages) > len(parts) {
+		last := len(r.messages) - 1
+		if err := r.bot.DeleteMessage(r.channelID, r.messages[last], "Streamed reply shortened"); err != nil {
+			return err
+		}
+		r.messages = r.messages[:last]
+		r.shown = r.shown[:last]
+		r.reused = r.reused[:last]
+	}
+
+	return nil
+}
+
+// edit replaces the text of the i-th message. A reused message also loses
+// the buttons of the earlier reply, which may no longer be its last part.
+func (r *streamRenderer) edit(i int, part string) error {
+	if !r.reused[i] {
+		_, err := r.bot.EditMessage(r.channelID, r.messages[i], part)
+		return err
+	}
+	_, err := r.bot.EditMessageComplex(r.channelID, r.messages[i], api.EditMessageData{
+		Content:    option.NewNullableString(part),
+		Components: &discord.ContainerComponents{},
+	})
+	if err == nil {
+		r.reused[i] = false
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/gateway"
+	"github.com/diamondburned/arikawa/v3/state"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+// maxThreadName is the longest thread name Discord accepts
+const maxThreadName = 100
+
+// ThreadStarter is the message a Discord thread was started from
+type ThreadStarter struct {
+	UserID   string
+	UserName string
+	Content  string
+	// FromBot is set when the thread was started from one of the bot's replies
+	FromBot bool
+}
+
+// isThread reports whether a channel is a thread
+func isThread(ch *discord.Channel) bool {
+	switch ch.Type {
+	case discord.GuildPublicThread, discord.GuildPrivateThread, discord.GuildAnnouncementThread:
+		return true
+	}
+	return false
+}
+
+// isAIChannelName reports whether the bot answers every message in a channel
+func isAIChannelName(name string) bool {
+	return strings.HasPrefix(name, "ai-")
+}
+
+// joinAIThread joins threads created in AI channels, since the bot only
+// receives the messages of private threads it is a member of
+func joinAIThread(bot *state.State, e *gateway.ThreadCreateEvent) {
+	parent, err := bot.Channel(e.ParentID)
+	if err != nil {
+		log.Printf("Error getting thread parent: %v", err)
+		return
+	}
+	if !isAIChannelName(parent.Name) && parent.ID != channelID {
+		return
+	}
+	if err := bot.JoinThread(e.ID); err != nil {
+		log.Printf("Error joining thread: %v", err)
+	}
+}
+
+// threadStarter returns the message a thread was started from, or nil for
+// threads started without one
+func threadStarter(bot *state.State, thread *discord.Channel) *ThreadStarter {
+	// A thread started from a message has the ID of that message
+	msg, err := bot.Message(thread.ParentID, discord.MessageID(thread.ID))
+	if err != nil {
+		return nil
+	}
+
+	content := strings.TrimSpace(strings.TrimPrefix(msg.Content, "!m "))
+	if content == "" {
+		return nil
+	}
+
+	starter := &ThreadStarter{UserID: msg.Author.ID.String(), UserName: msg.Author.Username, Content: content}
+	if me, err := bot.Me(); err == nil && msg.Author.ID == me.ID {
+		starter.FromBot = true
+	}
+	return starter
+}
+
+// saveStarter opens the history of a thread with the message it was started from
+func (ml *MLService) saveStarter(db *DBService, conversationID int64, starter ThreadStarter) {
+	var err error
+	if starter.FromBot {
+		_, err = db.AddAssistantMessage(conversationID, starter.UserID, "Kurosawa", starter.Content, FailoverTarget{})
+	} else {
+		err = db.AddUserMessage(conversationID, starter.UserID, starter.UserName, starter.Content, nil, "")
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save thread starter: %v\n", err)
+	}
+}
+
+// labelSpeakers starts each user turn with its author's name once several
+// people take part, so that the model can tell them apart
+func labelSpeakers(history []Message) []Message {
+	speakers := map[string]bool{}
+	for _, msg := range history {
+		if msg.Role == RoleUser {
+			speakers[msg.UserName] = true
+		}
+	}
+	if len(speakers) < 2 {
+		return history
+	}
+
+	labeled := slices.Clone(history)
+	for i, msg := range labeled {
+		if msg.Role == RoleUser {
+			labeled[i].Content = msg.UserName + ": " + msg.Content
+		}
+	}
+	return labeled
+}
+
+// threadCommand starts a thread for a fresh topic in an AI channel. The bot
+// answers every message in threads it started.
+func threadCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	ch, err := botState.Channel(data.Event.ChannelID)
+	if err != nil {
+		return threadResponse(fmt.Sprintf("Error getting channel: %v", err))
+	}
+	if isThread(ch) {
+		return threadResponse("This is already a thread. Use `/thread` in the channel it belongs to.")
+	}
+	if !isAIChannelName(ch.Name) && ch.ID != channelID {
+		return threadResponse(fmt.Sprintf("Threads can only be started in AI channels, such as <#%s>.", channelID))
+	}
+
+	name := strings.TrimSpace(data.Options.Find("topic").String())
+	if name == "" {
+		name = "Chat with Kurosawa"
+	}
+	thread, err := botState.StartThreadWithoutMessage(ch.ID, api.StartThreadData{
+		Name:                truncate(name, maxThreadName-1),
+		AutoArchiveDuration: discord.OneDayArchive,
+		Type:                discord.GuildPublicThread,
+	})
+	if err != nil {
+		return threadResponse(fmt.Sprintf("Error creating thread: %v", err))
+	}
+	if err := botState.AddThreadMember(thread.ID, data.Event.SenderID()); err != nil {
+		log.Printf("Error adding user to thread: %v", err)
+	}
+
+	return threadResponse(fmt.Sprintf("Started %s. Everyone in it shares one conversation with the AI.", thread.Mention()))
+}
+
+// threadResponse is a private reply to /thread
+func threadResponse(content string) *api.InteractionResponseData {
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(content),
+		Flags:   discord.EphemeralMessage,
+	}
+}
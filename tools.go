@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/state"
+)
+
+const (
+	DefaultToolMaxSteps = 5
+
+	// toolTimeout bounds a single tool run
+	toolTimeout = 20 * time.Second
+	// maxToolOutput keeps tool results from filling the context window
+	maxToolOutput = 8000
+)
+
+// Tool is a function the model can call. Run receives the arguments as a
+// JSON object and returns the text handed back to the model.
+type Tool struct {
+	Definition ToolDefinition
+	Run        func(ctx context.Context, user ChatUser, args json.RawMessage) (string, error)
+}
+
+// ToolRegistry holds the tools offered to the models. A nil registry offers
+// none.
+type ToolRegistry struct {
+	tools map[string]Tool
+	// order keeps definitions in registration order
+	order []string
+	// maxSteps is how many model calls one message may take, counting the
+	// final answer
+	maxSteps int
+}
+
+// NewToolRegistry creates an empty registry
+func NewToolRegistry(maxSteps int) *ToolRegistry {
+	if maxSteps < 1 {
+		maxSteps = DefaultToolMaxSteps
+	}
+	return &ToolRegistry{tools: make(map[string]Tool), maxSteps: maxSteps}
+}
+
+// toolRegistryFromEnv registers the built-in tools listed in TOOLS (all of
+// them when unset, none for "none") with TOOL_MAX_STEPS steps per message
+func toolRegistryFromEnv(bot *state.State) (*ToolRegistry, error) {
+	maxSteps := DefaultToolMaxSteps
+	if value := os.Getenv("TOOL_MAX_STEPS"); value != "" {
+		steps, err := strconv.Atoi(value)
+		if err != nil || steps < 1 {
+			return nil, fmt.Errorf("invalid TOOL_MAX_STEPS %q", value)
+		}
+		maxSteps = steps
+	}
+
+	builtin := builtinTools(bot)
+	registry := NewToolRegistry(maxSteps)
+
+	value := strings.TrimSpace(os.Getenv("TOOLS"))
+	switch value {
+	case "none":
+		return registry, nil
+	case "":
+		for _, tool := range builtin {
+			registry.Register(tool)
+		}
+		return registry, nil
+	}
+
+	for _, name := range splitList(value) {
+		i := slices.IndexFunc(builtin, func(tool Tool) bool { return tool.Definition.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown tool %q in TOOLS", name)
+		}
+		registry.Register(builtin[i])
+	}
+	return registry, nil
+}
+
+// Register adds a tool, replacing any tool with the same name
+func (r *ToolRegistry) Register(tool Tool) {
+	name := tool.Definition.Name
+	if _, exists := r.tools[name]; !exists {
+		r.order = append(r.order, name)
+	}
+	r.tools[name] = tool
+}
+
+// Definitions returns the definitions of every registered tool
+func (r *ToolRegistry) Definitions() []ToolDefinition {
+	if r == nil {
+		return nil
+	}
+	definitions := make([]ToolDefinition, 0, len(r.order))
+	for _, name := range r.order {
+		definitions = append(definitions, r.tools[name].Definition)
+	}
+	return definitions
+}
+
+// MaxSteps returns how many model calls one message may take
+func (r *ToolRegistry) MaxSteps() int {
+	if r == nil {
+		return 1
+	}
+	return r.maxSteps
+}
+
+// Run runs a tool call. Failures are returned as text so that the model can
+// tell the user or try something else.
+func (r *ToolRegistry) Run(ctx context.Context, user ChatUser, call ToolCall) string {
+	if r == nil {
+		return fmt.Sprintf("Error: unknown tool %q", call.Name)
+	}
+	tool, ok := r.tools[call.Name]
+	if !ok {
+		return fmt.Sprintf("Error: unknown tool %q", call.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+
+	output, err := tool.Run(ctx, user, json.RawMessage(call.Arguments))
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	if output == "" {
+		return "(no output)"
+	}
+	return truncate(output, maxToolOutput)
+}
+
+// builtinTools returns the tools that ship with the bot
+func builtinTools(bot *state.State) []Tool {
+	return []Tool{
+		{
+			Definition: ToolDefinition{
+				Name:        "fetch_url",
+				Description: "Fetch a web page and return the text of its paragraphs.",
+				Parameters: objectSchema(map[string]any{
+					"url": map[string]any{"type": "string", "description": "The http or https URL to fetch"},
+				}, "url"),
+			},
+			Run: fetchURLTool,
+		},
+		{
+			Definition: ToolDefinition{
+				Name:        "server_info",
+				Description: "Get information about the Discord server the conversation takes place in: name, description, owner, creation date, member, channel and role counts.",
+				Parameters:  objectSchema(map[string]any{}),
+			},
+			Run: func(ctx context.Context, user ChatUser, args json.RawMessage) (string, error) {
+				return serverInfoTool(bot, user)
+			},
+		},
+		{
+			Definition: ToolDefinition{
+				Name:        "calculate",
+				Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, the constants pi and e, and the functions sqrt, abs, round, floor, ceil, sin, cos, tan, log (base 10), ln and exp.",
+				Parameters: objectSchema(map[string]any{
+					"expression": map[string]any{"type": "string", "description": "The expression, e.g. (2 + 3) * sqrt(16)"},
+				}, "expression"),
+			},
+			Run: calculateTool,
+		},
+		{
+			Definition: ToolDefinition{
+				Name:        "current_time",
+				Description: "Get the current date and time.",
+				Parameters: objectSchema(map[string]any{
+					"timezone": map[string]any{"type": "string", "description": "IANA time zone such as Europe/Paris; UTC when omitted"},
+				}),
+			},
+			Run: currentTimeTool,
+		},
+	}
+}
+
+// objectSchema builds the JSON schema of an arguments object
+func objectSchema(properties map[string]any, required ...string) map[string]any {
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// parseToolArgs decodes tool arguments, treating empty arguments as {}
+func parseToolArgs(args json.RawMessage, v any) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+func fetchURLTool(ctx context.Context, user ChatUser, args json.RawMessage) (string, error) {
+	var params struct {
+		URL string `json:"url"`
+	}
+	if err := parseToolArgs(args, &params); err != nil {
+		return "", err
+	}
+
+	parsed, err := url.Parse(params.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("%q is not an http or https URL", params.URL)
+	}
+
+	content, err := ReadPage(ctx, parsed.String())
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(content) == "" {
+		return "The page has no paragraph text.", nil
+	}
+	return content, nil
+}
+
+func serverInfoTool(bot *state.State, user ChatUser) (string, error) {
+	if user.GuildID == "" {
+		return "", fmt.Errorf("the conversation is not in a server")
+	}
+	id, err := discord.ParseSnowflake(user.GuildID)
+	if err != nil {
+		return "", err
+	}
+	guildID := discord.GuildID(id)
+
+	guild, err := bot.GuildWithCount(guildID)
+	if err != nil {
+		return "", err
+	}
+
+	var info strings.Builder
+	fmt.Fprintf(&info, "Name: %s\n", guild.Name)
+	if guild.Description != "" {
+		fmt.Fprintf(&info, "Description: %s\n", guild.Description)
+	}
+	fmt.Fprintf(&info, "Owner: %s\n", guild.OwnerID.Mention())
+	fmt.Fprintf(&info, "Created: %s\n", guildID.Time().UTC().Format("2006-01-02"))
+	fmt.Fprintf(&info, "Members: about %d (%d online)\n", guild.ApproximateMembers, guild.ApproximatePresences)
+	if channels, err := bot.Channels(guildID); err == nil {
+		fmt.Fprintf(&info, "Channels: %d\n", len(channels))
+	}
+	if roles, err := bot.Roles(guildID); err == nil {
+		fmt.Fprintf(&info, "Roles: %d\n", len(roles))
+	}
+	return info.String(), nil
+}
+
+func calculateTool(ctx context.Context, user ChatUser, args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := parseToolArgs(args, &params); err != nil {
+		return "", err
+	}
+
+	result, err := evaluate(params.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+func currentTimeTool(ctx context.Context, user ChatUser, args json.RawMessage) (string, error) {
+	var params struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := parseToolArgs(args, &params); err != nil {
+		return "", err
+	}
+
+	location := time.UTC
+	if params.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(params.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone %q", params.Timezone)
+		}
+	}
+	return time.Now().In(location).Format("Monday, 2 January 2006 15:04:05 MST (-07:00)"), nil
+}
+
+// evaluate computes an arithmetic expression with a recursive-descent parser:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("+" | "-") unary | power
+//	power  = atom [ "^" unary ]
+//	atom   = number | constant | function "(" expr ")" | "(" expr ")"
+func evaluate(expression string) (float64, error) {
+	p := &exprParser{input: strings.ReplaceAll(expression, " ", "")}
+	if p.input == "" {
+		return 0, fmt.Errorf("empty expression")
+	}
+
+	result, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("the result is not a finite number")
+	}
+	return result, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+}
+
+// peek returns the next byte, or 0 at the end of the input
+func (p *exprParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			left += right
+		} else {
+			left -= right
+		}
+	}
+}
+
+func (p *exprParser) term() (float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case op == '*':
+			left *= right
+		case right == 0:
+			return 0, fmt.Errorf("division by zero")
+		case op == '/':
+			left /= right
+		default:
+			left = math.Mod(left, right)
+		}
+	}
+}
+
+func (p *exprParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		value, err := p.unary()
+		return -value, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	base, err := p.atom()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	// Right-associative: 2^3^2 is 2^(3^2)
+	exponent, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+// exprFunctions are the functions evaluate understands
+var exprFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"round": math.Round,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"log":   math.Log10,
+	"ln":    math.Log,
+	"exp":   math.Exp,
+}
+
+func (p *exprParser) atom() (float64, error) {
+	start := p.pos
+	c := p.peek()
+
+	switch {
+	case c == '(':
+		p.pos++
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		// Exponent notation such as 1.5e3
+		if p.peek() == 'e' && p.pos+1 < len(p.input) && (p.input[p.pos+1] >= '0' && p.input[p.pos+1] <= '9' || p.input[p.pos+1] == '-' || p.input[p.pos+1] == '+') {
+			p.pos += 2
+			for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+				p.pos++
+			}
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return value, nil
+
+	case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.input) && (p.input[p.pos] >= 'a' && p.input[p.pos] <= 'z' || p.input[p.pos] >= 'A' && p.input[p.pos] <= 'Z') {
+			p.pos++
+		}
+		name := strings.ToLower(p.input[start:p.pos])
+		switch name {
+		case "pi":
+			return math.Pi, nil
+		case "e":
+			return math.E, nil
+		}
+		fn, ok := exprFunctions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function or constant %q", name)
+		}
+		if p.peek() != '(' {
+			return 0, fmt.Errorf("%s needs parentheses, e.g. %s(2)", name, name)
+		}
+		arg, err := p.atom()
+		if err != nil {
+			return 0, err
+		}
+		return fn(arg), nil
+
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+	}
+}
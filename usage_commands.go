@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/diamondburned/arikawa/v3/api"
+	"github.com/diamondburned/arikawa/v3/api/cmdroute"
+	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/diamondburned/arikawa/v3/utils/json/option"
+)
+
+const (
+	defaultUsageDays = 30
+	// maxUsageDayRows keeps the per-day list inside one Discord message
+	maxUsageDayRows = 14
+)
+
+// usageCommand shows the user's token usage and cost by day and by model
+func (h *aiCommandHandler) usageCommand(ctx context.Context, data cmdroute.CommandData) *api.InteractionResponseData {
+	userID := data.Event.SenderID()
+
+	days := defaultUsageDays
+	if value, err := data.Options.Find("days").IntValue(); err == nil && value > 0 {
+		days = int(value)
+	}
+	since := time.Now().AddDate(0, 0, -days)
+
+	userDB, err := h.dbManager.GetUserDB(userID.String())
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot access database: %v", err))
+	}
+
+	byDay, err := userDB.GetUsageByDay(since)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get usage: %v", err))
+	}
+	byModel, err := userDB.GetUsageByModel(since)
+	if err != nil {
+		return h.errorResponse(fmt.Sprintf("Cannot get usage: %v", err))
+	}
+
+	if len(byDay) == 0 {
+		return &api.InteractionResponseData{
+			Content: option.NewNullableString(fmt.Sprintf("No AI usage in the last %d days.", days)),
+			Flags:   discord.EphemeralMessage,
+		}
+	}
+
+	var total UsageTotal
+	for _, day := range byDay {
+		total.Requests += day.Requests
+		total.PromptTokens += day.PromptTokens
+		total.CompletionTokens += day.CompletionTokens
+		total.Cost += day.Cost
+	}
+
+	response := fmt.Sprintf("**Your AI usage (last %d days):**\n", days)
+	response += fmt.Sprintf("Total: %s\n", formatUsage(total))
+
+	response += "\n**By model:**\n"
+	for _, model := range byModel {
+		response += fmt.Sprintf("• %s — %s, avg %s\n", model.Key, formatUsage(model), model.Latency.Round(100*time.Millisecond))
+	}
+
+	response += "\n**By day (UTC):**\n"
+	for i, day := range byDay {
+		if i == maxUsageDayRows {
+			response += fmt.Sprintf("…and %d earlier days\n", len(byDay)-i)
+			break
+		}
+		response += fmt.Sprintf("• %s — %s\n", day.Key, formatUsage(day))
+	}
+
+	return &api.InteractionResponseData{
+		Content: option.NewNullableString(truncate(response, MaxMessageLength)),
+		Flags:   discord.EphemeralMessage,
+	}
+}
+
+// formatUsage summarizes a usage total, e.g. "12 requests, 8k in / 2k out, $0.0123"
+func formatUsage(total UsageTotal) string {
+	summary := fmt.Sprintf("%d requests, %s in / %s out", total.Requests,
+		formatTokenCount(total.PromptTokens), formatTokenCount(total.CompletionTokens))
+	if total.Cost > 0 {
+		summary += fmt.Sprintf(", $%.4f", total.Cost)
+	}
+	return summary
+}